@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"hellopiers.io/ecr-copy/ecrcopy"
+)
+
+// readCopies reads the images to copy for -from-file.  Each line is
+//
+//	from-repo image-digest-or-tag to-repo [new-tag]
+//
+// like the arguments for copying one image, including keeping the tag if
+// there's no new one.  Blank lines, and lines starting
+// with #, are ignored.
+func readCopies(path string) ([]ecrcopy.ImageCopy, error) {
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var copies []ecrcopy.ImageCopy
+	scanner := bufio.NewScanner(f)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) < 3 || len(fields) > 4 {
+			return nil, fmt.Errorf("%s:%d: want from-repo image-digest-or-tag to-repo [new-tag], got %d fields", path, lineNo, len(fields))
+		}
+
+		ic := ecrcopy.ImageCopy{SourceRepo: fields[0], Ref: fields[1], DestRepo: fields[2]}
+		switch {
+		case len(fields) == 4:
+			ic.Tags = []string{fields[3]}
+		case isTag(ic.Ref):
+			ic.Tags = []string{ic.Ref}
+		}
+		for _, repo := range []string{ic.SourceRepo, ic.DestRepo} {
+			if _, ok, _ := splitECRRepo(repo); ok {
+				return nil, fmt.Errorf("%s:%d: give %s without its registry, which for -from-file is the one from the flags", path, lineNo, repo)
+			}
+		}
+		if _, name, ok := splitPublicRepo(ic.DestRepo); ok {
+			return nil, fmt.Errorf("%s:%d: give %s without its registry, as %s, and use -dest-public to copy to ECR Public", path, lineNo, ic.DestRepo, name)
+		}
+		if err := checkArgs(ic.SourceRepo, ic.Ref, ic.DestRepo, ic.Tags); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, lineNo, err)
+		}
+		copies = append(copies, ic)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	if len(copies) == 0 {
+		return nil, fmt.Errorf("%s: no images to copy", path)
+	}
+
+	return copies, nil
+}
+
+// readRefs reads the image-digest-or-tag when it's given as -, or several of
+// them one per line, ignoring blank lines and whitespace.
+func readRefs(r io.Reader) ([]string, error) {
+
+	var refs []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		if ref := strings.TrimSpace(scanner.Text()); ref != "" {
+			refs = append(refs, ref)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("stdin: %w", err)
+	}
+
+	if len(refs) == 0 {
+		return nil, fmt.Errorf("stdin: no image digest or tag, for an image-digest-or-tag of -")
+	}
+
+	return refs, nil
+}
+
+// printBatch writes a summary of how each copy went to stdout, as text or
+// JSON, and of what was transferred in the duration of them all, and returns
+// the first copy's error if any failed.  Copies that weren't tried because an
+// earlier one failed are reported as skipped.
+func printBatch(copies []ecrcopy.ImageCopy, results []ecrcopy.ImageCopyResult, duration time.Duration, asJSON bool) error {
+
+	type entry struct {
+		*ecrcopy.Result
+		Status string `json:"status"` // copied, up-to-date, replicated, failed or skipped
+		Error  string `json:"error,omitempty"`
+	}
+
+	var entries []entry
+	var firstErr error
+	failed := 0
+	for i, ic := range copies {
+		e := entry{
+			Result: &ecrcopy.Result{SourceRepo: ic.SourceRepo, SourceRef: ic.Ref, DestRepo: ic.DestRepo, DestTags: ic.Tags},
+			Status: "skipped",
+		}
+		if i < len(results) {
+			switch r := results[i]; {
+			case r.Err != nil:
+				e.Status = "failed"
+				e.Error = r.Err.Error()
+				if firstErr == nil {
+					firstErr = r.Err
+				}
+				failed++
+			case r.Result.UpToDate:
+				e.Result = r.Result
+				e.Status = "up-to-date"
+			case r.Result.Replicated:
+				e.Result = r.Result
+				e.Status = "replicated"
+			default:
+				e.Result = r.Result
+				e.Status = "copied"
+			}
+		}
+		entries = append(entries, e)
+	}
+
+	if asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		err := enc.Encode(struct {
+			Images          []entry `json:"images"`
+			Failed          int     `json:"failed"`
+			DurationSeconds float64 `json:"durationSeconds"`
+		}{entries, failed, duration.Seconds()})
+		if err != nil {
+			fatal(err)
+		}
+	} else {
+		for _, e := range entries {
+			fmt.Printf("%-10s %s %s -> %s", e.Status, e.SourceRepo, e.SourceRef, e.DestRepo)
+			if e.Error != "" {
+				fmt.Printf(": %s", e.Error)
+			}
+			fmt.Println()
+		}
+		fmt.Printf("%d of %d images copied, %d failed\n", len(results)-failed, len(copies), failed)
+
+		var transferred, skipped int64
+		var layers int
+		for _, r := range results {
+			if r.Result != nil {
+				transferred += r.Result.BytesTransferred
+				skipped += r.Result.BytesSkipped
+				layers += r.Result.LayersCopied
+			}
+		}
+		printSummary(transferred, layers, skipped, duration)
+	}
+
+	return firstErr
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReadCopies(t *testing.T) {
+
+	tests := []struct {
+		name    string
+		line    string
+		wantErr string
+	}{
+		{"names", "team/app v1 team/app-copy", ""},
+		{"from another registry", "docker.io/library/nginx 1.27 mirror/nginx", ""},
+		{"from ECR Public", "public.ecr.aws/docker/library/nginx 1.27 mirror/nginx", ""},
+		{"to ECR Public", "team/app v1 public.ecr.aws/myalias/app", "images.txt:1: give public.ecr.aws/myalias/app without its registry, as app, and use -dest-public to copy to ECR Public"},
+		{"ECR URL", "111111111111.dkr.ecr.us-east-1.amazonaws.com/team/app v1 team/app", "images.txt:1: give 111111111111.dkr.ecr.us-east-1.amazonaws.com/team/app without its registry"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			path := filepath.Join(t.TempDir(), "images.txt")
+			if err := os.WriteFile(path, []byte(tt.line+"\n"), 0o644); err != nil {
+				t.Fatal(err)
+			}
+
+			// The errors start with the path, which is in a temporary directory
+			copies, err := readCopies(path)
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Fatal(err)
+			case tt.wantErr != "" && (err == nil || !strings.HasPrefix(err.Error(), filepath.Join(filepath.Dir(path), tt.wantErr))):
+				t.Fatalf("got error %v, want one starting %q", err, tt.wantErr)
+			case tt.wantErr == "" && len(copies) != 1:
+				t.Fatalf("got %d copies, want 1", len(copies))
+			}
+		})
+	}
+}
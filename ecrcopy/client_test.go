@@ -0,0 +1,148 @@
+package ecrcopy
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ecr"
+	"github.com/aws/aws-sdk-go-v2/service/ecr/types"
+)
+
+// fakeClient is an in-memory ECR registry, with the images and layers of one
+// repo, whatever it's called.  It only does the calls the tests need; the rest
+// panic.
+type fakeClient struct {
+	Client
+
+	registryID string
+
+	mu          sync.Mutex
+	manifests   map[string]string // by digest
+	tags        map[string]string // the digest each tag is on
+	layers      map[string]bool
+	layerChecks []int    // how many digests each BatchCheckLayerAvailability had
+	calls       []string // the calls that changed anything
+}
+
+func newFakeClient(registryID string) *fakeClient {
+
+	return &fakeClient{
+		registryID: registryID,
+		manifests:  map[string]string{},
+		tags:       map[string]string{},
+		layers:     map[string]bool{},
+	}
+}
+
+// addImage puts the manifest in the repo with the tag, and returns its digest.
+func (f *fakeClient) addImage(manifest, tag string) string {
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	digest := fakeDigest(manifest)
+	f.manifests[digest] = manifest
+	if tag != "" {
+		f.tags[tag] = digest
+	}
+
+	return digest
+}
+
+// fakeDigest returns the digest of the content.
+func fakeDigest(content string) string {
+
+	sum := sha256.Sum256([]byte(content))
+
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+func (f *fakeClient) BatchGetImage(_ context.Context, in *ecr.BatchGetImageInput, _ ...func(*ecr.Options)) (*ecr.BatchGetImageOutput, error) {
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	out := &ecr.BatchGetImageOutput{}
+	for _, id := range in.ImageIds {
+		digest := aws.ToString(id.ImageDigest)
+		if id.ImageTag != nil {
+			digest = f.tags[*id.ImageTag]
+		}
+		manifest, ok := f.manifests[digest]
+		if !ok {
+			out.Failures = append(out.Failures, types.ImageFailure{ImageId: &id, FailureCode: types.ImageFailureCodeImageNotFound})
+			continue
+		}
+		out.Images = append(out.Images, types.Image{
+			ImageId:       &types.ImageIdentifier{ImageDigest: aws.String(digest), ImageTag: id.ImageTag},
+			ImageManifest: aws.String(manifest),
+		})
+	}
+
+	return out, nil
+}
+
+func (f *fakeClient) BatchCheckLayerAvailability(_ context.Context, in *ecr.BatchCheckLayerAvailabilityInput, _ ...func(*ecr.Options)) (*ecr.BatchCheckLayerAvailabilityOutput, error) {
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if len(in.LayerDigests) > maxLayerChecks {
+		return nil, fmt.Errorf("%d digests, more than %d", len(in.LayerDigests), maxLayerChecks)
+	}
+	f.layerChecks = append(f.layerChecks, len(in.LayerDigests))
+
+	// Like ECR, missing layers are failures rather than unavailable layers
+	out := &ecr.BatchCheckLayerAvailabilityOutput{}
+	for _, d := range in.LayerDigests {
+		if f.layers[d] {
+			out.Layers = append(out.Layers, types.Layer{LayerDigest: aws.String(d), LayerAvailability: types.LayerAvailabilityAvailable})
+		} else {
+			out.Failures = append(out.Failures, types.LayerFailure{LayerDigest: aws.String(d), FailureCode: types.LayerFailureCodeMissingLayerDigest})
+		}
+	}
+
+	return out, nil
+}
+
+func (f *fakeClient) PutImage(_ context.Context, in *ecr.PutImageInput, _ ...func(*ecr.Options)) (*ecr.PutImageOutput, error) {
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	digest := fakeDigest(aws.ToString(in.ImageManifest))
+	f.manifests[digest] = aws.ToString(in.ImageManifest)
+	if in.ImageTag != nil {
+		f.tags[*in.ImageTag] = digest
+	}
+	f.calls = append(f.calls, fmt.Sprintf("PutImage %s %s", aws.ToString(in.ImageTag), digest))
+
+	return &ecr.PutImageOutput{Image: &types.Image{ImageId: &types.ImageIdentifier{ImageDigest: &digest, ImageTag: in.ImageTag}}}, nil
+}
+
+func (f *fakeClient) BatchDeleteImage(_ context.Context, in *ecr.BatchDeleteImageInput, _ ...func(*ecr.Options)) (*ecr.BatchDeleteImageOutput, error) {
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, id := range in.ImageIds {
+		digest := aws.ToString(id.ImageDigest)
+		delete(f.manifests, digest)
+		for tag, d := range f.tags {
+			if d == digest {
+				delete(f.tags, tag)
+			}
+		}
+		f.calls = append(f.calls, "BatchDeleteImage "+digest)
+	}
+
+	return &ecr.BatchDeleteImageOutput{}, nil
+}
+
+func (f *fakeClient) DescribeRegistry(context.Context, *ecr.DescribeRegistryInput, ...func(*ecr.Options)) (*ecr.DescribeRegistryOutput, error) {
+	return &ecr.DescribeRegistryOutput{RegistryId: &f.registryID}, nil
+}
@@ -0,0 +1,654 @@
+// Package ecrcopy copies images between AWS ECR repositories using the
+// low-level layer upload API, without docker.
+package ecrcopy
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/ecr"
+	"github.com/aws/aws-sdk-go-v2/service/ecr/types"
+)
+
+// Options are the optional parts of a copy.  The zero value copies one layer
+// at a time, and logs nothing.
+type Options struct {
+
+	// Dest is the client for the destination repo, if it's not the same as the
+	// one for the source (e.g. another account or region).
+	Dest Client
+
+	// Concurrency is the maximum number of layers copied at once.
+	Concurrency int
+
+	// MaxRetries is how many times to retry uploads and the layer downloads
+	// when they're throttled or fail in a way that might be temporary, and how
+	// many times a layer download can reconnect after failing part way.
+	MaxRetries int
+
+	// MaxURLRefreshes is how many times a layer download can get a new URL
+	// from the source because the one it had expired, e.g. on a slow link.
+	MaxURLRefreshes int
+
+	// CreateRepo, if not nil, is how to create the destination repo if it
+	// doesn't already exist.
+	CreateRepo *RepoSettings
+
+	// KMSKey, if set, is the ARN or ID of the KMS key the destination repo is
+	// meant to be encrypted with.  If it isn't, that's a warning, or an error
+	// with RequireKMS, before anything is copied.  A repo made by CreateRepo
+	// is encrypted with it.
+	KMSKey string
+
+	// RequireKMS makes it an error for the destination repo not to be
+	// encrypted with KMSKey, or if that isn't set, with KMS at all.
+	RequireKMS bool
+
+	// CopySignatures also copies an image's cosign signatures, attestations and
+	// SBOMs, which are in tags named after its digest (sha256-<hex>.sig etc.).
+	// It only applies to CopyImage(s); CopyRepository copies all tags anyway.
+	CopySignatures bool
+
+	// DeleteSource deletes the image from the source repo once it's been
+	// copied, making it a move.  The image is deleted by digest, so all its tags
+	// go too.  It can't be used with Platforms.  It only applies to
+	// CopyImage(s).
+	DeleteSource bool
+
+	// Overwrite says existing tags in the destination are meant to be replaced.
+	// That's what happens anyway if its tags are mutable; if they're immutable
+	// it's an error, before anything is copied.  It only applies to CopyImage(s).
+	Overwrite bool
+
+	// Scan starts a scan of the copied image, unless the destination repo scans
+	// on push.  With WaitScan, it waits for the scan to finish (for up to 15
+	// minutes) and puts the counts of findings in the Result.  A scan that
+	// can't be done is logged, not an error.  It only applies to CopyImage(s).
+	Scan     bool
+	WaitScan bool
+
+	// Verify checks the copy is pullable once it's done, before any
+	// DeleteSource: that its manifests are there and ECR says its layers are,
+	// and that a few of the layers, downloaded again, have the right digest.
+	// VerifyFull downloads all of them.  A problem is an error.  It only
+	// applies to CopyImage(s).
+	Verify     bool
+	VerifyFull bool
+
+	// Platforms, if any, are the only platforms of an index to copy, as
+	// os/arch or os/arch/variant, e.g. linux/amd64.  The index put in the
+	// destination only has those in it, so has a different digest.
+	Platforms []string
+
+	// ForceRecopy uploads every layer, even if ECR says it's already in the
+	// destination, to repair an image whose layers are there but broken.
+	ForceRecopy bool
+
+	// RetagOnly just puts the image's manifest with the new tags, after
+	// checking its layers are all in the destination already, and it's an
+	// error if they aren't.  That's what happens anyway when the source and
+	// destination repo are the same, unless ForceRecopy.
+	RetagOnly bool
+
+	// SkipUpToDate checks first whether the destination tags are already the
+	// source image, and if so doesn't copy it or scan it again, though its
+	// signatures are still copied and the source deleted if asked.  It doesn't
+	// apply with Platforms or ForceRecopy, or to an untagged copy.  It only
+	// applies to CopyImage(s).
+	SkipUpToDate bool
+
+	// PreferReplication first checks whether one of the source registry's
+	// replication rules copies the image to the destination, in which case it
+	// waits up to ReplicationWait (by default 10 minutes) for it to get there
+	// instead of copying it.  If there's no rule, or it doesn't get there, it's
+	// copied.  Replication keeps the repo name and tags, so it's only for
+	// copies which do too, and it doesn't apply with Platforms, ForceRecopy or
+	// RetagOnly.  It only applies to CopyImage(s).
+	PreferReplication bool
+	ReplicationWait   time.Duration
+
+	// RateLimit, if more than 0, is the most bytes a second to copy, for all
+	// the layers being copied at once together.
+	RateLimit int64
+
+	// HTTPClient is for the layer downloads, and reading from registries other
+	// than ECR.  If nil, a client is made with HTTPTimeout for the response
+	// headers; a custom one (e.g. for a proxy) should have its own timeouts.
+	HTTPClient *http.Client
+
+	// HTTPTimeout is how long a layer download can go without receiving
+	// anything before it's abandoned, and reconnected if there are retries
+	// left.  The default is a minute.
+	HTTPTimeout time.Duration
+
+	// ContinueOnError carries on with the rest of the copies after one fails.
+	// It only applies to CopyImages.
+	ContinueOnError bool
+
+	// StateFile, if set, is a file to keep track of layer uploads in, so that
+	// if a copy is interrupted, running it again carries on with the upload of
+	// a layer from where it got to, instead of starting that layer again.
+	StateFile string
+
+	// DryRun finds out what would be copied, without changing anything.
+	DryRun bool
+
+	// Logger gets messages about what's going on: what's been copied at Info,
+	// retries and other trouble at Warn, and each call's details at Debug.
+	Logger *slog.Logger
+
+	// Progress, if not nil, is told how the layer uploads are going.
+	Progress Progress
+}
+
+// Progress is told how the layer uploads are going, e.g. to show a progress
+// bar.  LayerProgress is called from the concurrent layer copies, so must be
+// safe for that.
+type Progress interface {
+
+	// Start is called before copying an image's layers, with how many there
+	// are and their total size.
+	Start(layers int, size int64)
+
+	// LayerProgress is called after each part of a layer has been uploaded,
+	// with how much of it has been uploaded so far.
+	LayerProgress(digest string, uploaded, size int64)
+
+	// Finish is called when the image's layers have been copied, or failed.
+	Finish()
+}
+
+type noProgress struct{}
+
+func (noProgress) Start(int, int64)                   {}
+func (noProgress) LayerProgress(string, int64, int64) {}
+func (noProgress) Finish()                            {}
+
+// Result describes a copy, or with DryRun what a copy would do.  The fields
+// about a single image are left empty by CopyRepository.
+type Result struct {
+	SourceRepo   string   `json:"sourceRepo"`
+	SourceRef    string   `json:"sourceRef,omitempty"`    // the tag or digest asked for
+	SourceDigest string   `json:"sourceDigest,omitempty"` // what it resolved to
+	DestRepo     string   `json:"destRepo"`
+	DestTags     []string `json:"destTags,omitempty"`
+	DestDigest   string   `json:"destDigest,omitempty"` // what ECR says was put
+	UpToDate     bool     `json:"upToDate,omitempty"`   // the destination already had it, so nothing was copied
+	Replicated   bool     `json:"replicated,omitempty"` // ECR replication copied it, so this didn't
+
+	Images       int   `json:"images"`       // images copied, not counting the platforms of an index
+	Layers       int   `json:"layers"`       // layers in the images, counting each once per image
+	LayersNeeded int   `json:"layersNeeded"` // how many of them weren't already in the destination
+	BytesNeeded  int64 `json:"bytesNeeded"`  // the manifest sizes of the needed layers
+	BytesSkipped int64 `json:"bytesSkipped"` // and of the rest, which didn't need copying
+
+	LayersCopied     int   `json:"layersCopied"`
+	BytesTransferred int64 `json:"bytesTransferred"` // what was actually uploaded
+
+	Signatures int `json:"signatures,omitempty"` // signatures etc. copied, also counted in Images
+
+	ScanStatus   string           `json:"scanStatus,omitempty"`   // ECR's scan status, or one of the Scan... constants
+	ScanFindings map[string]int32 `json:"scanFindings,omitempty"` // by severity, if the scan was waited for
+
+	Verified       bool `json:"verified,omitempty"`
+	LayersVerified int  `json:"layersVerified,omitempty"` // downloaded again and their digests checked
+
+	Duration time.Duration `json:"-"`
+}
+
+// add adds the counts from o to r.
+func (r *Result) add(o *Result) {
+	r.Images += o.Images
+	r.Layers += o.Layers
+	r.LayersNeeded += o.LayersNeeded
+	r.BytesNeeded += o.BytesNeeded
+	r.BytesSkipped += o.BytesSkipped
+	r.LayersCopied += o.LayersCopied
+	r.BytesTransferred += o.BytesTransferred
+	r.Signatures += o.Signatures
+}
+
+// copier holds what's common to all the steps of a copy.
+type copier struct {
+	src, dst    Client
+	registry    *registrySource // for sources that aren't ECR
+	httpClient  *http.Client
+	httpTimeout time.Duration
+	limiter     *rateLimiter
+	state       *stateFile
+	platforms   []string
+	forceRecopy bool
+	retagOnly   bool
+	concurrency int
+	maxRetries  int
+	maxRefresh  int // of a download's expired URL
+	createRepo  *RepoSettings
+	kmsKey      string
+	requireKMS  bool
+	dryRun      bool
+	log         *slog.Logger
+	progress    Progress
+
+	// present is the layers known to be in the destination, so that layers
+	// shared by several images are only checked and copied once.
+	present map[string]bool
+
+	// same is whether src and dst are the same registry, once sameRegistry
+	// has found out.
+	same *bool
+}
+
+func newCopier(client Client, opts Options) *copier {
+
+	c := &copier{
+		src:         client,
+		dst:         opts.Dest,
+		concurrency: opts.Concurrency,
+		maxRetries:  opts.MaxRetries,
+		maxRefresh:  opts.MaxURLRefreshes,
+		createRepo:  opts.CreateRepo,
+		kmsKey:      opts.KMSKey,
+		requireKMS:  opts.RequireKMS,
+		dryRun:      opts.DryRun,
+		log:         opts.Logger,
+		progress:    opts.Progress,
+		present:     map[string]bool{},
+		httpClient:  opts.HTTPClient,
+		httpTimeout: opts.HTTPTimeout,
+		limiter:     newRateLimiter(opts.RateLimit),
+		state:       newStateFile(opts.StateFile),
+		platforms:   opts.Platforms,
+		forceRecopy: opts.ForceRecopy,
+		retagOnly:   opts.RetagOnly,
+	}
+	if c.httpTimeout <= 0 {
+		c.httpTimeout = defaultHTTPTimeout
+	}
+	if c.httpClient == nil {
+		c.httpClient = newHTTPClient(c.httpTimeout)
+	}
+	c.registry = newRegistrySource(c.httpClient)
+	if c.dst == nil {
+		c.dst = client
+	}
+	if c.log == nil {
+		c.log = slog.New(slog.DiscardHandler)
+	}
+	if c.progress == nil {
+		c.progress = noProgress{}
+	}
+
+	return c
+}
+
+// CopyImage copies the image with the given tag or digest from srcRepo to
+// dstRepo, and gives it each of the tags there, or leaves it untagged if there
+// are none.  The layers are only copied once however many tags there are.  The
+// client is used for the source, and the destination unless opts.Dest is set.
+//
+// The ref is a tag, or a digest as sha256:<hex> or name@sha256:<hex>.
+//
+// The srcRepo can also be in another registry, e.g. docker.io/library/nginx or
+// ghcr.io/owner/image, if it's public.  It's taken to be one if the first part
+// of it has a dot in it, like docker does, so an ECR repo named that way can't
+// be copied from.
+func CopyImage(ctx context.Context, srcRepo, ref, dstRepo string, tags []string, client Client, opts Options) (*Result, error) {
+
+	return newCopier(client, opts).copyOne(ctx, srcRepo, ref, dstRepo, tags, opts)
+}
+
+// ImageCopy is one of the copies for CopyImages, with the same meanings as the
+// arguments to CopyImage.
+type ImageCopy struct {
+	SourceRepo string
+	Ref        string
+	DestRepo   string
+	Tags       []string
+}
+
+// ImageCopyResult is how one of the copies by CopyImages went: either Result
+// or Err is set.
+type ImageCopyResult struct {
+	ImageCopy
+	Result *Result
+	Err    error
+}
+
+// CopyImages does each of the copies in turn, as CopyImage would, except that
+// layers shared by the images are only checked and copied once.  It stops at
+// the first one that fails unless opts.ContinueOnError, so there may be fewer
+// results than copies; it always stops if ctx is cancelled.
+func CopyImages(ctx context.Context, copies []ImageCopy, client Client, opts Options) []ImageCopyResult {
+
+	c := newCopier(client, opts)
+
+	var results []ImageCopyResult
+	for _, ic := range copies {
+		result, err := c.copyOne(ctx, ic.SourceRepo, ic.Ref, ic.DestRepo, ic.Tags, opts)
+		results = append(results, ImageCopyResult{ImageCopy: ic, Result: result, Err: err})
+		if err != nil {
+			c.log.Error("Copy failed", "from", ic.SourceRepo, "ref", ic.Ref, "to", ic.DestRepo, "error", err)
+			if !opts.ContinueOnError || ctx.Err() != nil {
+				break
+			}
+		}
+	}
+
+	return results
+}
+
+// copyOne does what CopyImage says.
+func (c *copier) copyOne(ctx context.Context, srcRepo, ref, dstRepo string, tags []string, opts Options) (*Result, error) {
+
+	start := time.Now()
+
+	if opts.DeleteSource && srcRepo == dstRepo {
+		same, err := c.sameRegistry(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("DeleteSource can't tell if %s is both source and destination, which would delete the copy: %w", srcRepo, err)
+		}
+		if same {
+			return nil, fmt.Errorf("DeleteSource would delete the copy, since %s is both source and destination", srcRepo)
+		}
+	}
+	if opts.CopySignatures && len(opts.Platforms) > 0 {
+		return nil, fmt.Errorf("CopySignatures can't be used with Platforms, since the signatures would be of an index that isn't copied")
+	}
+	if opts.DeleteSource && len(opts.Platforms) > 0 {
+		return nil, fmt.Errorf("DeleteSource can't be used with Platforms, since it would delete the whole index when only some of it is copied")
+	}
+	if _, _, ok := splitRegistry(srcRepo); ok && (opts.DeleteSource || opts.CopySignatures) {
+		return nil, fmt.Errorf("DeleteSource and CopySignatures need the source to be in ECR, and %s isn't", srcRepo)
+	}
+
+	result := &Result{
+		SourceRepo: srcRepo,
+		SourceRef:  ref,
+		DestRepo:   dstRepo,
+		DestTags:   tags,
+	}
+
+	if opts.SkipUpToDate && len(tags) > 0 && len(opts.Platforms) == 0 && !opts.ForceRecopy {
+		var err error
+		result.SourceDigest, result.DestDigest, result.UpToDate, err = c.upToDate(ctx, srcRepo, ref, dstRepo, tags)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if !result.UpToDate && opts.PreferReplication && len(opts.Platforms) == 0 && !opts.ForceRecopy && !opts.RetagOnly {
+		var err error
+		result.Replicated, err = c.replicated(ctx, srcRepo, ref, dstRepo, tags, opts.ReplicationWait, result)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	switch {
+	case result.UpToDate:
+		c.log.Info("Already up to date", "ref", ref, "from", srcRepo, "to", dstRepo, "digest", result.DestDigest)
+	case result.Replicated:
+		// which replicated has logged
+	default:
+		err := c.prepareDest(ctx, dstRepo)
+		if err != nil {
+			return nil, err
+		}
+
+		if opts.Overwrite {
+			err = c.checkOverwrite(ctx, dstRepo, tags)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		err = c.copyImage(ctx, srcRepo, ref, dstRepo, tags, result)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if opts.CopySignatures {
+		err := c.copySignatures(ctx, srcRepo, result.SourceDigest, dstRepo, result)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if (opts.Scan || opts.WaitScan) && !opts.DryRun && !result.UpToDate {
+		err := c.scan(ctx, dstRepo, result.DestDigest, opts.WaitScan, result)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if (opts.Verify || opts.VerifyFull) && !opts.DryRun {
+		err := c.verify(ctx, dstRepo, result.DestDigest, opts.VerifyFull, result)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if opts.DeleteSource {
+		err := c.deleteSource(ctx, srcRepo, result.SourceDigest)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	result.Duration = time.Since(start)
+
+	return result, nil
+}
+
+// CopyRepository copies every tagged image in srcRepo to dstRepo, with the
+// same tags.  Untagged images aren't copied, except as platforms of an index.
+func CopyRepository(ctx context.Context, srcRepo, dstRepo string, client Client, opts Options) (*Result, error) {
+
+	start := time.Now()
+	c := newCopier(client, opts)
+
+	if _, _, ok := splitRegistry(srcRepo); ok {
+		return nil, fmt.Errorf("CopyRepository needs the source to be in ECR, and %s isn't", srcRepo)
+	}
+
+	images, err := c.listTagged(ctx, srcRepo)
+	if err != nil {
+		return nil, err
+	}
+
+	c.log.Info("Listed tagged images", "repo", srcRepo, "images", len(images))
+
+	err = c.prepareDest(ctx, dstRepo)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &Result{
+		SourceRepo: srcRepo,
+		DestRepo:   dstRepo,
+	}
+	for _, ti := range images {
+		err = c.copyImage(ctx, srcRepo, ti.Digest, dstRepo, ti.Tags, result)
+		if err != nil {
+			return nil, fmt.Errorf("%s (%s): %w", ti.Digest, strings.Join(ti.Tags, ","), err)
+		}
+	}
+
+	// These are only meaningful for a single image
+	result.SourceDigest = ""
+	result.DestDigest = ""
+
+	result.Duration = time.Since(start)
+
+	return result, nil
+}
+
+// sameRegistry is whether the source and destination are the same registry,
+// i.e. the same account and region, so that a repo with the same name in each
+// is the same repo.  Separate clients can be for the same registry, e.g. with
+// different credentials.
+func (c *copier) sameRegistry(ctx context.Context) (bool, error) {
+
+	if c.same != nil {
+		return *c.same, nil
+	}
+
+	same, err := c.compareRegistries(ctx)
+	if err != nil {
+		return false, err
+	}
+	c.same = &same
+
+	return same, nil
+}
+
+func (c *copier) compareRegistries(ctx context.Context) (bool, error) {
+
+	// Comparing the clients themselves could panic for a type that can't be
+	// compared, but a pointer is fine
+	src, srcOK := c.src.(*ecr.Client)
+	dst, dstOK := c.dst.(*ecr.Client)
+	if srcOK && dstOK && src == dst {
+		return true, nil
+	}
+	if _, ok := c.dst.(publicClient); ok {
+		return false, nil
+	}
+	if regionOf(c.src) != regionOf(c.dst) {
+		return false, nil
+	}
+
+	srcID, err := registryIDOf(ctx, c.src)
+	if err != nil {
+		return false, err
+	}
+	dstID, err := registryIDOf(ctx, c.dst)
+	if err != nil {
+		return false, err
+	}
+
+	return srcID == dstID, nil
+}
+
+// prepareDest does whatever's needed before copying anything to dstRepo.
+func (c *copier) prepareDest(ctx context.Context, dstRepo string) error {
+
+	if c.createRepo != nil && !c.dryRun {
+		err := c.ensureRepo(ctx, dstRepo, *c.createRepo)
+		if err != nil {
+			return err
+		}
+	}
+
+	if c.kmsKey != "" || c.requireKMS {
+		return c.checkEncryption(ctx, dstRepo)
+	}
+
+	return nil
+}
+
+// copyImage copies one image, putting its manifest once for each of the tags,
+// or just once untagged if there are none, and adds to result.
+func (c *copier) copyImage(ctx context.Context, srcRepo, ref, dstRepo string, tags []string, result *Result) error {
+
+	img, err := c.getManifest(ctx, c.sourceFor(srcRepo), srcRepo, ref)
+	if err != nil {
+		return err
+	}
+
+	layers := img.allLayers()
+	if len(img.Children) > 0 {
+		c.log.Debug("Image is an index", "platforms", len(img.Children))
+	}
+
+	neededLayers, err := c.checkLayerAvails(ctx, dstRepo, layers)
+	if err != nil {
+		if !(c.dryRun && c.createRepo != nil && isErr[*types.RepositoryNotFoundException](err)) {
+			return err
+		}
+		c.log.Info("Repository would be created", "repo", dstRepo)
+		neededLayers = c.notPresent(c.distributable(layers))
+	}
+
+	c.log.Info("Checked layers", "layers", len(layers), "toCopy", len(neededLayers))
+
+	// Within a repo the layers must all be there, unless they're suspect
+	retag := c.retagOnly
+	if _, _, other := splitRegistry(srcRepo); !retag && srcRepo == dstRepo && !other && !c.forceRecopy {
+		retag, err = c.sameRegistry(ctx)
+		if err != nil {
+			c.log.Warn("Can't tell if the copy is within one repo, so copying it as if it isn't", "repo", srcRepo, "error", err)
+			retag = false
+		}
+	}
+	if retag && len(neededLayers) > 0 {
+		return fmt.Errorf("%s can't just be retagged, since %d of its layers aren't in %s", ref, len(neededLayers), dstRepo)
+	}
+
+	result.Images++
+	result.Layers += len(layers)
+	result.LayersNeeded += len(neededLayers)
+	needed := map[string]bool{}
+	for _, l := range neededLayers {
+		result.BytesNeeded += l.Size
+		needed[l.Digest] = true
+	}
+	for _, l := range layers {
+		if !needed[l.Digest] && !l.isForeign() {
+			result.BytesSkipped += l.Size
+		}
+	}
+
+	result.SourceDigest = img.Digest
+	if img.Unfiltered != "" {
+		result.SourceDigest = img.Unfiltered
+	}
+
+	if !c.dryRun {
+		transferred, err := c.copyLayers(ctx, srcRepo, dstRepo, neededLayers)
+		result.BytesTransferred += transferred
+		if err != nil {
+			return err
+		}
+		result.LayersCopied += len(neededLayers)
+	}
+
+	for _, l := range layers {
+		c.present[l.Digest] = true
+	}
+
+	if c.dryRun {
+		return nil
+	}
+
+	// An index's children have to be present before the index itself can be put
+	for _, child := range img.Children {
+		_, err = c.putManifest(ctx, dstRepo, "", child)
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(tags) == 0 {
+		tags = []string{""}
+	}
+	for _, tag := range tags {
+		result.DestDigest, err = c.putManifest(ctx, dstRepo, tag, img)
+		if err != nil {
+			return err
+		}
+	}
+
+	if retag {
+		c.log.Info("Retagged", "ref", ref, "from", srcRepo, "to", dstRepo, "tags", tags)
+	} else {
+		c.log.Info("Copied", "ref", ref, "from", srcRepo, "to", dstRepo)
+	}
+
+	return nil
+}
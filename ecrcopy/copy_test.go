@@ -0,0 +1,130 @@
+package ecrcopy
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// testManifest is an image manifest whose config and layers are the digests
+// of the contents.
+func testManifest(contents ...string) (manifest string, blobs []string) {
+
+	var layers []string
+	for _, c := range contents {
+		digest := fakeDigest(c)
+		blobs = append(blobs, digest)
+		layers = append(layers, fmt.Sprintf(`{"mediaType":"application/vnd.oci.image.layer.v1.tar+gzip","digest":%q,"size":%d}`, digest, len(c)))
+	}
+
+	config := fakeDigest("config")
+	blobs = append(blobs, config)
+	manifest = fmt.Sprintf(`{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json","config":{"mediaType":"application/vnd.oci.image.config.v1+json","digest":%q,"size":6},"layers":[%s]}`,
+		config, strings.Join(layers, ","))
+
+	return manifest, blobs
+}
+
+func TestDeleteSourceSameRepo(t *testing.T) {
+
+	manifest, blobs := testManifest("a", "b")
+
+	tests := []struct {
+		name      string
+		dstID     string
+		wantErr   string
+		wantCalls string // to the source, then the destination
+	}{
+		{
+			name:      "same registry, other client",
+			dstID:     "111111111111",
+			wantErr:   "DeleteSource would delete the copy",
+			wantCalls: "[] []",
+		},
+		{
+			name:      "other account",
+			dstID:     "222222222222",
+			wantCalls: fmt.Sprintf("[BatchDeleteImage %s] [PutImage v2 %s]", fakeDigest(manifest), fakeDigest(manifest)),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			src := newFakeClient("111111111111")
+			src.addImage(manifest, "v1")
+			dst := newFakeClient(tt.dstID)
+			for _, b := range blobs {
+				dst.layers[b] = true
+			}
+
+			_, err := CopyImage(context.Background(), "app", "v1", "app", []string{"v2"}, src, Options{Dest: dst, DeleteSource: true})
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Fatal(err)
+			case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+				t.Fatalf("got error %v, want %q", err, tt.wantErr)
+			}
+
+			if got := fmt.Sprint(src.calls, " ", dst.calls); got != tt.wantCalls {
+				t.Errorf("calls %s, want %s", got, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestRetagSameRepo(t *testing.T) {
+
+	manifest, blobs := testManifest("a", "b")
+
+	tests := []struct {
+		name    string
+		present int // how many of the blobs the destination has
+		wantErr string
+	}{
+		{"all layers there", len(blobs), ""},
+		{"layer missing", len(blobs) - 1, "v1 can't just be retagged, since 1 of its layers aren't in app"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			// Separate clients for the same registry, as the command makes
+			src := newFakeClient("111111111111")
+			src.addImage(manifest, "v1")
+			dst := newFakeClient("111111111111")
+			for _, b := range blobs[:tt.present] {
+				dst.layers[b] = true
+			}
+
+			_, err := CopyImage(context.Background(), "app", "v1", "app", []string{"v2"}, src, Options{Dest: dst})
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Fatal(err)
+			case tt.wantErr != "" && (err == nil || err.Error() != tt.wantErr):
+				t.Fatalf("got error %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// uncomparableClient is a Client that == panics on, having a slice in it.
+type uncomparableClient struct {
+	*fakeClient
+	_ []string
+}
+
+func TestSameRegistryUncomparable(t *testing.T) {
+
+	client := uncomparableClient{fakeClient: newFakeClient("111111111111")}
+	c := newCopier(client, Options{Dest: client})
+
+	same, err := c.sameRegistry(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !same {
+		t.Error("the same client isn't the same registry")
+	}
+}
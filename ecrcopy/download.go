@@ -0,0 +1,232 @@
+package ecrcopy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// layerReader reads a layer's content from the source.  If the connection
+// fails part way, it gets a fresh request from the source (an ECR download URL
+// may have expired)
+// and carries on from where it got to with a ranged GET, so what it returns is
+// still exactly the layer's bytes in order.
+type layerReader struct {
+	ctx        context.Context
+	c          *copier
+	src        source
+	repo       string
+	digest     string
+	offset     int64 // how much of the layer has been read
+	body       io.ReadCloser
+	reconnects int
+	refreshes  int    // of an expired URL
+	content    []byte // if set, the layer's content, so there's nothing to GET
+}
+
+// newLayerReader returns a reader of the layer in src from offset bytes in.
+func (c *copier) newLayerReader(ctx context.Context, src source, sourceRepo, layerDigest string, offset int64) *layerReader {
+	return &layerReader{ctx: ctx, c: c, src: src, repo: sourceRepo, digest: layerDigest, offset: offset}
+}
+
+func (r *layerReader) Read(b []byte) (int, error) {
+
+	for {
+		if r.body == nil {
+			err := r.open()
+			if err != nil {
+				return 0, err
+			}
+		}
+
+		n, err := r.body.Read(b)
+		r.offset += int64(n)
+		if err == nil || errors.Is(err, io.EOF) {
+			return n, err
+		}
+
+		r.body.Close()
+		r.body = nil
+
+		if r.ctx.Err() != nil || r.reconnects >= r.c.maxRetries {
+			return n, err
+		}
+		r.reconnects++
+
+		r.c.log.Warn("Layer download failed, reconnecting", "layer", r.digest, "offset", r.offset, "error", err)
+
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+func (r *layerReader) Close() error {
+	if r.body == nil {
+		return nil
+	}
+	return r.body.Close()
+}
+
+// open starts a GET of the layer from r.offset.
+func (r *layerReader) open() error {
+
+	if r.content != nil {
+		r.body = io.NopCloser(bytes.NewReader(r.content[min(r.offset, int64(len(r.content))):]))
+		return nil
+	}
+
+	req, err := r.src.blobRequest(r.ctx, r.repo, r.digest)
+	if err != nil {
+		return err
+	}
+	if r.offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", r.offset))
+	}
+
+	// The request is cancelled if the body stalls, which only this request
+	// should see as an error, so as to reconnect.
+	reqCtx, cancel := context.WithCancel(r.ctx)
+	req = req.WithContext(reqCtx)
+
+	var resp *http.Response
+	err = r.c.retry(r.ctx, "GET layer", func() (err error) {
+		resp, err = r.c.httpClient.Do(req)
+		if err == nil && resp.StatusCode >= 500 {
+			err = readStatusError(resp)
+		}
+		return err
+	})
+	if err != nil {
+		cancel()
+		return fmt.Errorf("http GET layer(%s): %w", r.digest, err)
+	}
+	body := newIdleTimeoutBody(resp.Body, r.c.httpTimeout, cancel)
+
+	switch {
+	case resp.StatusCode == http.StatusPartialContent && r.offset > 0:
+		if !strings.HasPrefix(resp.Header.Get("Content-Range"), fmt.Sprintf("bytes %d-", r.offset)) {
+			body.Close()
+			return fmt.Errorf("http GET layer(%s) from %d: got Content-Range %q", r.digest, r.offset, resp.Header.Get("Content-Range"))
+		}
+
+	case resp.StatusCode == http.StatusOK:
+		if r.offset > 0 {
+			// The Range was ignored and we've got the whole thing, so skip what
+			// we've already had.
+			r.c.log.Info("Range not supported, skipping what was already read", "layer", r.digest, "bytes", r.offset)
+			_, err = io.CopyN(io.Discard, body, r.offset)
+			if err != nil {
+				body.Close()
+				return fmt.Errorf("http GET layer(%s) skipping %d bytes: %w", r.digest, r.offset, err)
+			}
+		}
+
+	default:
+		// e.g. a 403 from S3 for an expired URL, with an XML error body which
+		// mustn't be taken for the layer
+		statusErr := readStatusError(resp)
+		body.Close()
+		if isExpiredURL(statusErr) && r.refreshes < r.c.maxRefresh {
+			// On a slow link a layer can take longer than a URL lasts, so the
+			// reconnect needs a new one rather than a retry
+			r.refreshes++
+			r.c.log.Warn("Download URL has expired, getting a new one", "layer", r.digest, "offset", r.offset, "refreshes", r.refreshes)
+			return r.open()
+		}
+		return fmt.Errorf("http GET layer(%s): %w", r.digest, statusErr)
+	}
+
+	r.body = body
+
+	return nil
+}
+
+// isExpiredURL is whether the error is S3 saying a presigned URL has expired,
+// or the credentials it was signed with have.
+func isExpiredURL(err httpStatusError) bool {
+
+	if err.StatusCode != http.StatusForbidden && err.StatusCode != http.StatusBadRequest {
+		return false
+	}
+
+	return strings.Contains(err.Body, "<Code>ExpiredToken</Code>") ||
+		strings.Contains(err.Body, "<Message>Request has expired</Message>")
+}
+
+// defaultHTTPTimeout is how long a download can stall, unless Options say.
+const defaultHTTPTimeout = time.Minute
+
+// maxRedirects is how many redirects a download can have.  A presigned URL
+// shouldn't need any, but registries redirect blobs to their CDN.
+const maxRedirects = 5
+
+// newHTTPClient returns a client like the default one, which has timeouts for
+// connecting, but also with a timeout for the response headers, and which only
+// follows a few redirects, and not from https to http.
+func newHTTPClient(timeout time.Duration) *http.Client {
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ResponseHeaderTimeout = timeout
+
+	return &http.Client{
+		Transport: transport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= maxRedirects {
+				return fmt.Errorf("stopped after %d redirects", maxRedirects)
+			}
+			if via[0].URL.Scheme == "https" && req.URL.Scheme != "https" {
+				return fmt.Errorf("won't follow a redirect from https to %s", req.URL.Redacted())
+			}
+			return nil
+		},
+	}
+}
+
+// idleTimeoutBody is a response body which cancels the request if a Read
+// takes longer than the timeout.  Only the time spent in Read counts, not the
+// time between them while what's been read is uploaded.
+type idleTimeoutBody struct {
+	body    io.ReadCloser
+	timeout time.Duration
+	timer   *time.Timer
+	cancel  context.CancelFunc
+	expired atomic.Bool
+}
+
+func newIdleTimeoutBody(body io.ReadCloser, timeout time.Duration, cancel context.CancelFunc) *idleTimeoutBody {
+
+	b := &idleTimeoutBody{body: body, timeout: timeout, cancel: cancel}
+	b.timer = time.AfterFunc(timeout, func() {
+		b.expired.Store(true)
+		cancel()
+	})
+	b.timer.Stop()
+
+	return b
+}
+
+func (b *idleTimeoutBody) Read(p []byte) (int, error) {
+
+	b.timer.Reset(b.timeout)
+	n, err := b.body.Read(p)
+	b.timer.Stop()
+
+	if err != nil && b.expired.Load() {
+		err = fmt.Errorf("nothing received for %v: %w", b.timeout, err)
+	}
+
+	return n, err
+}
+
+func (b *idleTimeoutBody) Close() error {
+	b.timer.Stop()
+	b.cancel()
+	return b.body.Close()
+}
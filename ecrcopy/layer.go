@@ -0,0 +1,484 @@
+package ecrcopy
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ecr"
+	"github.com/aws/aws-sdk-go-v2/service/ecr/types"
+)
+
+// maxLayerChecks is the most digests BatchCheckLayerAvailability takes at once.
+const maxLayerChecks = 100
+
+// checkLayerAvails returns the layers which aren't available in the destination.
+// Layers already known to be there aren't checked again, and foreign layers are
+// left out altogether.  With forceRecopy, all the others are needed.
+func (c *copier) checkLayerAvails(ctx context.Context, destRepo string, layers []imageLayer) ([]imageLayer, error) {
+
+	layers = c.notPresent(c.distributable(layers))
+
+	// What ECR says is available is what's suspect, so don't ask
+	if c.forceRecopy {
+		return layers, nil
+	}
+
+	return c.unavailable(ctx, destRepo, layers)
+}
+
+// unavailable returns the layers which ECR says aren't available in the
+// destination.
+func (c *copier) unavailable(ctx context.Context, destRepo string, layers []imageLayer) ([]imageLayer, error) {
+
+	destHasLayer := map[string]bool{}
+
+	for start := 0; start < len(layers); start += maxLayerChecks {
+		end := min(start+maxLayerChecks, len(layers))
+
+		batchInput := &ecr.BatchCheckLayerAvailabilityInput{
+			RepositoryName: &destRepo,
+		}
+		for _, l := range layers[start:end] {
+			batchInput.LayerDigests = append(batchInput.LayerDigests, l.Digest)
+		}
+
+		avails, err := c.dst.BatchCheckLayerAvailability(ctx, batchInput)
+		if err != nil {
+			return nil, fmt.Errorf("BatchCheckLayerAvailability: %w", err)
+		}
+
+		for _, la := range avails.Layers {
+			if la.LayerAvailability == types.LayerAvailabilityAvailable {
+				destHasLayer[aws.ToString(la.LayerDigest)] = true
+			}
+		}
+	}
+
+	var unavailLayers []imageLayer
+	for _, l := range layers {
+		if destHasLayer[l.Digest] {
+			continue
+		}
+		unavailLayers = append(unavailLayers, l)
+	}
+
+	return unavailLayers, nil
+}
+
+// distributable returns the layers that aren't foreign, logging the ones which
+// are.  They stay in the manifest, but there's nothing to upload.
+func (c *copier) distributable(layers []imageLayer) []imageLayer {
+
+	var result []imageLayer
+	for _, l := range layers {
+		if l.isForeign() {
+			c.log.Info("Skipping foreign layer", "layer", l.Digest, "mediaType", l.MediaType, "urls", l.URLs)
+			continue
+		}
+		result = append(result, l)
+	}
+
+	return result
+}
+
+// notPresent returns the layers not already known to be in the destination.
+func (c *copier) notPresent(layers []imageLayer) []imageLayer {
+
+	var unknown []imageLayer
+	for _, l := range layers {
+		if !c.present[l.Digest] {
+			unknown = append(unknown, l)
+		}
+	}
+
+	return unknown
+}
+
+// copyLayers runs copyLayer for each of the layers, with at most concurrency of
+// them in progress at once.  Once one fails no more are started, the rest are
+// cancelled, and the first failure is what's returned.  It also returns how
+// many bytes were uploaded.
+func (c *copier) copyLayers(ctx context.Context, sourceRepo, destRepo string, layers []imageLayer) (int64, error) {
+
+	concurrency := c.concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	var total int64
+	for _, l := range layers {
+		total += l.Size
+	}
+	c.progress.Start(len(layers), total)
+	defer c.progress.Finish()
+
+	copyCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		wg       sync.WaitGroup
+		sem      = make(chan struct{}, concurrency)
+		failOnce sync.Once
+		firstErr error
+		uploaded atomic.Int64
+	)
+
+dispatch:
+	for _, l := range layers {
+		if l.isForeign() {
+			continue // not in the registry to copy
+		}
+
+		sem <- struct{}{} // blocks while concurrency copies are in progress
+
+		select {
+		case <-copyCtx.Done():
+			<-sem
+			break dispatch
+		default:
+		}
+
+		wg.Add(1)
+		go func(l imageLayer) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			n, err := c.copyLayer(copyCtx, sourceRepo, destRepo, l)
+			uploaded.Add(n)
+			if err != nil {
+				failOnce.Do(func() {
+					firstErr = fmt.Errorf("copyLayer: %w", err)
+					cancel()
+				})
+			}
+		}(l)
+	}
+
+	wg.Wait()
+
+	if firstErr == nil && ctx.Err() != nil {
+		// Cancelled from outside between copies
+		return uploaded.Load(), ctx.Err()
+	}
+
+	return uploaded.Load(), firstErr
+}
+
+// copyLayer downloads the layer from the source and uploads it to the
+// destination.  Only the download comes from the source; all the upload calls
+// go to c.dst.  The download carries on from where it was if the connection
+// drops.
+//
+// The downloaded content is checked against the size and digest in the manifest,
+// and the upload is abandoned rather than completed if it doesn't match.
+//
+// It returns how many bytes were uploaded, even if it fails.
+func (c *copier) copyLayer(ctx context.Context, sourceRepo, destRepo string, l imageLayer) (uploaded int64, err error) {
+
+	layerDigest := l.Digest
+
+	// A layer has to be uploaded in at least one part, and a part can't be
+	// empty, so there's no way to upload an empty blob.
+	if l.Size == 0 {
+		return 0, fmt.Errorf("layer %s: can't upload an empty layer", layerDigest)
+	}
+
+	// Carry on with an upload an earlier copy didn't finish, if there is one
+	upload, sha, start, err := c.resumeUpload(destRepo, layerDigest)
+	if err != nil {
+		return 0, err
+	}
+
+	body := c.newLayerReader(ctx, c.sourceFor(sourceRepo), sourceRepo, layerDigest, start)
+	body.content = l.content()
+	defer body.Close()
+
+	if start < l.Size {
+		err = body.open()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	if upload == nil {
+		err = c.retry(ctx, "InitiateLayerUpload", func() (err error) {
+			upload, err = c.dst.InitiateLayerUpload(ctx, &ecr.InitiateLayerUploadInput{
+				RepositoryName: &destRepo,
+			})
+			return err
+		})
+		if isErr[*types.LayerAlreadyExistsException](err) {
+			// Pushed by something else since we checked, which is all we wanted
+			c.layerExists(layerDigest, "")
+			c.progress.LayerProgress(layerDigest, l.Size, l.Size)
+			return uploaded, nil
+		}
+		if err != nil {
+			return uploaded, fmt.Errorf("InitiateLayerUpload: %w", err)
+		}
+		if upload.PartSize == nil || *upload.PartSize <= 0 {
+			return uploaded, fmt.Errorf("InitiateLayerUpload: no part size for upload %s", *upload.UploadId)
+		}
+	}
+
+	// There's no way to abort an upload, so on failure all we can do is say
+	// which one is left behind.  Any retry of the copy starts a new upload,
+	// unless there's a state file to carry on from.
+	defer func() {
+		if err != nil && upload != nil {
+			reason := err
+			if ctx.Err() != nil {
+				reason = ctx.Err()
+			}
+			c.log.Warn("Abandoned upload", "upload", *upload.UploadId, "layer", layerDigest, "uploaded", uploaded, "resumable", c.state != nil, "error", reason)
+		}
+	}()
+
+	partSize := uploadPartSize(*upload.PartSize, l.Size)
+	if partSize != *upload.PartSize {
+		c.log.Debug("Using bigger parts to stay within the number of parts", "layer", layerDigest, "size", l.Size, "ecrPartSize", *upload.PartSize, "maxParts", maxLayerParts)
+	}
+
+	c.log.Debug("Starting upload", "upload", *upload.UploadId, "layer", layerDigest, "partSize", partSize, "from", start)
+
+	// The next part is downloaded while the previous one uploads.  Parts are
+	// uploaded in order, each carrying on from the last, as ECR needs.
+	parts := make(chan layerPart, 1)
+	readCtx, cancelRead := context.WithCancel(ctx)
+	defer cancelRead()
+
+	var readErr error
+	go func() {
+		defer close(parts)
+		if start < l.Size {
+			readErr = readParts(readCtx, c.limiter.reader(readCtx, body), start, l.Size, partSize, parts)
+		}
+	}()
+
+	partFirstByte := start
+	lastPart := false
+	for part := range parts {
+		size := int64(part.data.Len())
+
+		// ECR needs every part but the last to be the same size.  readParts
+		// makes sure of that, but it'd be an unrecoverable upload if it didn't.
+		err = checkPart(part, size, partFirstByte, partSize, lastPart)
+		if err != nil {
+			cancelRead()
+			for range parts {
+				// let the reader finish
+			}
+			return uploaded, fmt.Errorf("layer %s: %w", layerDigest, err)
+		}
+		lastPart = size < partSize
+		partLastByte := partFirstByte + size - 1
+
+		err = c.retry(ctx, "UploadLayerPart", func() error {
+			_, err := c.dst.UploadLayerPart(ctx, &ecr.UploadLayerPartInput{
+				LayerPartBlob:  part.data.Bytes(),
+				PartFirstByte:  &partFirstByte,
+				PartLastByte:   &partLastByte,
+				RepositoryName: &destRepo,
+				UploadId:       upload.UploadId,
+			})
+			return err
+		})
+		if err != nil && partFirstByte == start && start > 0 && uploadGone(err) {
+			// The upload being resumed has expired, so start again
+			cancelRead()
+			for range parts {
+				// let the reader finish
+			}
+			c.log.Info("Upload to resume has gone, starting again", "upload", *upload.UploadId, "layer", layerDigest)
+			err = c.state.remove(destRepo, layerDigest)
+			if err != nil {
+				return uploaded, err
+			}
+			body.Close()
+			upload = nil
+			return c.copyLayer(ctx, sourceRepo, destRepo, l)
+		}
+		if err != nil {
+			cancelRead()
+			for range parts {
+				// let the reader finish
+			}
+			return uploaded, fmt.Errorf("UploadLayerPart(%s) (%d-%d): %w", layerDigest, partFirstByte, partLastByte, err)
+		}
+
+		c.log.Debug("Uploaded part", "layer", layerDigest, "first", partFirstByte, "last", partLastByte)
+
+		sha.Write(part.data.Bytes())
+		partBuffers.Put(part.data)
+		partFirstByte += size
+		uploaded += size
+
+		err = c.state.save(destRepo, layerDigest, upload, sha, partFirstByte)
+		if err != nil {
+			cancelRead()
+			for range parts {
+				// let the reader finish
+			}
+			return uploaded, err
+		}
+
+		c.progress.LayerProgress(layerDigest, partFirstByte, l.Size)
+	}
+
+	if readErr != nil {
+		return uploaded, fmt.Errorf("Read(%s): %w", layerDigest, readErr)
+	}
+
+	if partFirstByte == 0 {
+		return uploaded, fmt.Errorf("layer %s: no content downloaded", layerDigest)
+	}
+	if partFirstByte != l.Size {
+		return uploaded, fmt.Errorf("layer %s: manifest size is %d but downloaded %d bytes", layerDigest, l.Size, partFirstByte)
+	}
+
+	uploadDigest := "sha256:" + hex.EncodeToString(sha.Sum(nil))
+	if uploadDigest != layerDigest {
+		return uploaded, fmt.Errorf("layer %s: downloaded content has digest %s", layerDigest, uploadDigest)
+	}
+
+	var layer *ecr.CompleteLayerUploadOutput
+	err = c.retry(ctx, "CompleteLayerUpload", func() (err error) {
+		layer, err = c.dst.CompleteLayerUpload(ctx, &ecr.CompleteLayerUploadInput{
+			RepositoryName: &destRepo,
+			UploadId:       upload.UploadId,
+			LayerDigests:   []string{uploadDigest},
+		})
+		return err
+	})
+	if err != nil && start == l.Size && uploadGone(err) {
+		// All of it was uploaded before, but the upload has expired since
+		c.log.Info("Upload to resume has gone, starting again", "upload", *upload.UploadId, "layer", layerDigest)
+		err = c.state.remove(destRepo, layerDigest)
+		if err != nil {
+			return uploaded, err
+		}
+		body.Close()
+		upload = nil
+		return c.copyLayer(ctx, sourceRepo, destRepo, l)
+	}
+	if isErr[*types.LayerAlreadyExistsException](err) {
+		// Another push of the same layer finished first, but what we uploaded
+		// checked out, so it's the same content
+		c.layerExists(layerDigest, *upload.UploadId)
+		return uploaded, c.state.remove(destRepo, layerDigest)
+	}
+	if err != nil {
+		return uploaded, fmt.Errorf("CompleteLayerUpload(%s): %w", layerDigest, err)
+	}
+
+	c.log.Debug("Completed upload", "layer", layerDigest, "response", fmt.Sprintf("%#v", layer))
+
+	return uploaded, c.state.remove(destRepo, layerDigest)
+}
+
+// layerExists logs that ECR says the layer being uploaded is already there.
+// That's fine unless it's being recopied because it's broken, since ECR keeps
+// the layer it has rather than replacing it.
+func (c *copier) layerExists(digest, uploadID string) {
+
+	if c.forceRecopy {
+		c.log.Warn("Layer already exists, so ECR kept the one it has rather than the recopy", "layer", digest, "upload", uploadID)
+		return
+	}
+
+	c.log.Debug("Layer already exists, so the upload wasn't needed", "layer", digest, "upload", uploadID)
+}
+
+// uploadGone is whether the error is from carrying on with an upload that ECR
+// no longer has, because it's expired.
+func uploadGone(err error) bool {
+	return isErr[*types.UploadNotFoundException](err) || isErr[*types.InvalidLayerPartException](err)
+}
+
+// maxLayerParts is the most parts ECR lets a layer upload have.
+const maxLayerParts = 10000
+
+// uploadPartSize returns the size of the parts to upload a layer of size bytes
+// in, which is ECR's part size unless that would take too many parts.  Then
+// it's the smallest multiple of ECR's part size which doesn't, so the parts are
+// still at least as big as ECR wants.
+func uploadPartSize(ecrPartSize, size int64) int64 {
+
+	parts := (size + ecrPartSize - 1) / ecrPartSize
+	if parts <= maxLayerParts {
+		return ecrPartSize
+	}
+
+	return ecrPartSize * ((parts + maxLayerParts - 1) / maxLayerParts)
+}
+
+// checkPart is whether the part can be uploaded next, given where the last one
+// ended and whether it was short, so must have been the last.
+func checkPart(part layerPart, size, first, partSize int64, afterLast bool) error {
+
+	switch {
+	case part.first != first:
+		return fmt.Errorf("part at %d follows one ending at %d", part.first, first)
+	case size == 0:
+		return fmt.Errorf("empty part at %d", first)
+	case size > partSize:
+		return fmt.Errorf("part at %d is %d bytes, more than the part size %d", first, size, partSize)
+	case afterLast:
+		return fmt.Errorf("part at %d follows a short part, which must be the last", first)
+	}
+
+	return nil
+}
+
+// layerPart is part of a layer's content, starting at first.
+type layerPart struct {
+	data  *bytes.Buffer
+	first int64
+}
+
+// partBuffers are the buffers for parts that have been uploaded, to be used
+// again for the next parts of any layer rather than each one allocating its
+// own, since they're big.
+var partBuffers = sync.Pool{New: func() any { return new(bytes.Buffer) }}
+
+// readParts reads r, which starts first bytes into a layer of size bytes, in
+// parts of partSize bytes, the last one possibly shorter, and sends them in
+// order.  A layer which is an exact multiple of partSize has no short last
+// part.
+func readParts(ctx context.Context, r io.Reader, first, size, partSize int64, parts chan<- layerPart) error {
+
+	for {
+		// Only as big as the rest of the layer, which is often much less than
+		// a part, and with extra space so ReadFrom doesn't grow it when it's full
+		data := partBuffers.Get().(*bytes.Buffer)
+		data.Reset()
+		data.Grow(int(max(min(partSize, size-first), 0)) + bytes.MinRead)
+
+		// the reader can return less than we want; ReadFrom aggregates till we
+		// have a full part or it's the end of the layer
+		n, err := data.ReadFrom(io.LimitReader(r, partSize))
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return nil
+		}
+
+		select {
+		case parts <- layerPart{data: data, first: first}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		first += n
+		if n < partSize {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,218 @@
+package ecrcopy
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"testing"
+	"testing/iotest"
+)
+
+func TestUnavailable(t *testing.T) {
+
+	dst := newFakeClient("111111111111")
+	var layers []imageLayer
+	var want []string
+	for i := range 250 {
+		l := imageLayer{Digest: fakeDigest(fmt.Sprint("layer ", i)), Size: 1}
+		layers = append(layers, l)
+		if i%3 == 0 {
+			dst.layers[l.Digest] = true
+		} else {
+			want = append(want, l.Digest)
+		}
+	}
+
+	c := newCopier(dst, Options{})
+	missing, err := c.unavailable(context.Background(), "app", layers)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for _, l := range missing {
+		got = append(got, l.Digest)
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("got %d unavailable layers, want %d in the same order", len(got), len(want))
+	}
+	if fmt.Sprint(dst.layerChecks) != "[100 100 50]" {
+		t.Errorf("checked %v digests at a time, want [100 100 50]", dst.layerChecks)
+	}
+}
+
+func TestReadPartsShortReads(t *testing.T) {
+
+	content := bytes.Repeat([]byte("0123456789"), 1000)
+	const partSize = 3000
+
+	// One byte at a time, which readParts has to make into whole parts
+	parts := make(chan layerPart, 10)
+	err := readParts(context.Background(), iotest.OneByteReader(bytes.NewReader(content)), 0, int64(len(content)), partSize, parts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	close(parts)
+
+	var got []byte
+	var sizes []int
+	for part := range parts {
+		if part.first != int64(len(got)) {
+			t.Errorf("part starts at %d, want %d", part.first, len(got))
+		}
+		got = append(got, part.data.Bytes()...)
+		sizes = append(sizes, part.data.Len())
+	}
+
+	if fmt.Sprint(sizes) != "[3000 3000 3000 1000]" {
+		t.Errorf("got parts of %v bytes, want [3000 3000 3000 1000]", sizes)
+	}
+	if !bytes.Equal(got, content) {
+		t.Error("parts don't add up to the content")
+	}
+}
+
+func TestReadPartsSizes(t *testing.T) {
+
+	const partSize = 1000
+
+	tests := []struct {
+		name  string
+		size  int
+		parts string // their sizes
+	}{
+		{"exact multiple of the part size", 3 * partSize, "[1000 1000 1000]"},
+		{"smaller than one part", 10, "[10]"},
+		{"zero bytes", 0, "[]"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			parts := make(chan layerPart, 10)
+			err := readParts(context.Background(), bytes.NewReader(make([]byte, tt.size)), 0, int64(tt.size), partSize, parts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			close(parts)
+
+			// As copyLayer checks them before uploading
+			sizes := []int{}
+			var first int64
+			lastPart := false
+			for part := range parts {
+				size := int64(part.data.Len())
+				if err := checkPart(part, size, first, partSize, lastPart); err != nil {
+					t.Errorf("checkPart: %v", err)
+				}
+				lastPart = size < partSize
+				first += size
+				sizes = append(sizes, part.data.Len())
+			}
+
+			if fmt.Sprint(sizes) != tt.parts {
+				t.Errorf("got parts of %v bytes, want %s", sizes, tt.parts)
+			}
+		})
+	}
+}
+
+func TestCheckPart(t *testing.T) {
+
+	const partSize = 1000
+	part := func(first int64, size int) layerPart {
+		return layerPart{data: bytes.NewBuffer(make([]byte, size)), first: first}
+	}
+
+	tests := []struct {
+		name      string
+		part      layerPart
+		first     int64
+		afterLast bool
+		wantErr   string
+	}{
+		{"whole part", part(1000, 1000), 1000, false, ""},
+		{"short last part", part(2000, 10), 2000, false, ""},
+		{"gap", part(2000, 1000), 1000, false, "part at 2000 follows one ending at 1000"},
+		{"empty", part(1000, 0), 1000, false, "empty part at 1000"},
+		{"too big", part(0, 1001), 0, false, "part at 0 is 1001 bytes, more than the part size 1000"},
+		{"after a short part", part(1010, 1000), 1010, true, "part at 1010 follows a short part, which must be the last"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			err := checkPart(tt.part, int64(tt.part.data.Len()), tt.first, partSize, tt.afterLast)
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Errorf("got error %v", err)
+			case tt.wantErr != "" && (err == nil || err.Error() != tt.wantErr):
+				t.Errorf("got error %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCopyEmptyLayer(t *testing.T) {
+
+	c := newCopier(newFakeClient("111111111111"), Options{})
+	l := imageLayer{Digest: fakeDigest(""), Size: 0}
+
+	_, err := c.copyLayer(context.Background(), "app", "copy", l)
+	if want := "layer " + l.Digest + ": can't upload an empty layer"; err == nil || err.Error() != want {
+		t.Errorf("got error %v, want %q", err, want)
+	}
+}
+
+func TestUploadPartSize(t *testing.T) {
+
+	const ecrPartSize = 10 << 20
+
+	tests := []struct {
+		name string
+		size int64
+		want int64
+	}{
+		{"exactly the most parts", maxLayerParts * ecrPartSize, ecrPartSize},
+		{"one part too many", maxLayerParts*ecrPartSize + 1, 2 * ecrPartSize},
+		{"huge", 5 << 40, 53 * ecrPartSize},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			got := uploadPartSize(ecrPartSize, tt.size)
+			if got != tt.want {
+				t.Errorf("got %d, want %d", got, tt.want)
+			}
+			if got%ecrPartSize != 0 {
+				t.Errorf("%d isn't a multiple of ECR's part size", got)
+			}
+			if parts := (tt.size + got - 1) / got; parts > maxLayerParts {
+				t.Errorf("%d byte parts make %d of them, more than %d", got, parts, maxLayerParts)
+			}
+		})
+	}
+}
+
+// BenchmarkReadParts reads many small layers with ECR's usual part size, as
+// for an image of lots of small layers, where each part's buffer should be
+// the size of the layer and used again for the next.
+func BenchmarkReadParts(b *testing.B) {
+
+	const partSize = 20 << 20
+	layer := bytes.Repeat([]byte("x"), 4<<10)
+	parts := make(chan layerPart, 1)
+
+	b.ReportAllocs()
+	for b.Loop() {
+		for range 100 {
+			err := readParts(context.Background(), bytes.NewReader(layer), 0, int64(len(layer)), partSize, parts)
+			if err != nil {
+				b.Fatal(err)
+			}
+			part := <-parts
+			partBuffers.Put(part.data)
+		}
+	}
+}
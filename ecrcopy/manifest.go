@@ -0,0 +1,390 @@
+package ecrcopy
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ecr"
+	"github.com/aws/aws-sdk-go-v2/service/ecr/types"
+)
+
+// parseRef splits an image reference into a digest or a tag.  A digest can be
+// given as sha256:<hex>, or name@sha256:<hex> as docker shows it; anything
+// else with a colon in it is a malformed digest, since tags can't have one.
+func parseRef(ref string) (digest, tag string, err error) {
+
+	// name@ is just for show: it's the repo we've been told about separately
+	if i := strings.LastIndex(ref, "@"); i >= 0 {
+		ref = ref[i+1:]
+		if !strings.Contains(ref, ":") {
+			return "", "", fmt.Errorf("%q after @ is not a digest", ref)
+		}
+	}
+
+	algorithm, hex, isDigest := strings.Cut(ref, ":")
+	if !isDigest {
+		if ref == "" {
+			return "", "", fmt.Errorf("empty tag")
+		}
+		return "", ref, nil
+	}
+
+	if algorithm != "sha256" {
+		return "", "", fmt.Errorf("digest %q: unsupported algorithm %q, only sha256 is", ref, algorithm)
+	}
+	if !hexRe.MatchString(hex) {
+		return "", "", fmt.Errorf("digest %q: want 64 lowercase hex digits after sha256:, got %d characters", ref, len(hex))
+	}
+
+	return ref, "", nil
+}
+
+// getManifest fetches the image's manifest from src, and for an index the
+// manifests it references.
+func (c *copier) getManifest(ctx context.Context, src source, sourceRepo, imageDigestOrTag string) (*image, error) {
+
+	digest, tag, err := parseRef(imageDigestOrTag)
+	if err != nil {
+		return nil, err
+	}
+
+	manifestBytes, mediaType, manifestDigest, err := src.fetchManifest(ctx, sourceRepo, digest, tag)
+	if err != nil {
+		return nil, err
+	}
+
+	var m manifest
+	err = json.Unmarshal(manifestBytes, &m)
+	if err != nil {
+		return nil, fmt.Errorf("Unmarshal ImageManifest: %w", err)
+	}
+
+	// A schema 1 manifest has fsLayers rather than layers, so would seem to have
+	// none at all, and ECR wouldn't have them to copy anyway.
+	if m.SchemaVersion == 1 || strings.HasPrefix(mediaType, mediaTypeDockerManifestV1) {
+		return nil, fmt.Errorf("%s: unsupported manifest schema version 1; pull and push the image with a recent docker to convert it to schema 2", imageDigestOrTag)
+	}
+	if m.SchemaVersion > 2 {
+		return nil, fmt.Errorf("%s: unsupported manifest schema version %d", imageDigestOrTag, m.SchemaVersion)
+	}
+
+	result := &image{
+		Digest:    manifestDigest,
+		MediaType: m.MediaType,
+		Manifest:  string(manifestBytes),
+	}
+	if result.MediaType == "" {
+		result.MediaType = mediaType
+	}
+
+	if !isIndex(result.MediaType) {
+		result.Config = m.Config
+		result.Layers = m.Layers
+		c.log.Debug("Got manifest", "digest", manifestDigest, "config", m.Config.MediaType, "layers", len(m.Layers))
+		return result, nil
+	}
+
+	if len(c.platforms) > 0 {
+		err = c.filterPlatforms(result, &m)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", imageDigestOrTag, err)
+		}
+	}
+
+	// An index has no layers of its own, just references to per-platform manifests
+	// in the same repo, which we fetch by digest.
+	for _, d := range m.Manifests {
+		child, err := c.getManifest(ctx, src, sourceRepo, d.Digest)
+		if err != nil {
+			return nil, fmt.Errorf("index child %s (%s): %w", d.Digest, d.Platform, err)
+		}
+		if isIndex(child.MediaType) {
+			return nil, fmt.Errorf("index child %s is itself an index", d.Digest)
+		}
+		result.Children = append(result.Children, child)
+	}
+
+	return result, nil
+}
+
+// putManifest puts the image's manifest in the destination, and returns the
+// digest ECR gives it.
+func (c *copier) putManifest(ctx context.Context, destRepo, newTag string, img *image) (string, error) {
+
+	input := &ecr.PutImageInput{
+		RepositoryName: &destRepo,
+		ImageManifest:  &img.Manifest,
+	}
+
+	if img.MediaType != "" {
+		input.ImageManifestMediaType = &img.MediaType
+	}
+
+	if img.Digest != "" {
+		input.ImageDigest = &img.Digest
+	}
+
+	if newTag != "" {
+		input.ImageTag = &newTag
+	}
+
+	var o *ecr.PutImageOutput
+	err := c.retry(ctx, "PutImage", func() (err error) {
+		o, err = c.dst.PutImage(ctx, input)
+		return err
+	})
+	if err != nil {
+		if newTag == "" && isErr[*types.ImageAlreadyExistsException](err) {
+			// Typically an index child for a platform that was copied before
+			c.log.Debug("Manifest already present", "digest", img.Digest)
+			return img.Digest, nil
+		}
+		if isErr[*types.ImageTagAlreadyExistsException](err) {
+			return "", c.immutableTagError(ctx, destRepo, newTag, err)
+		}
+		return "", fmt.Errorf("PutImage: %w", err)
+	}
+
+	c.log.Debug("Put manifest", "digest", img.Digest, "tag", newTag, "response", fmt.Sprintf("%#v", o))
+
+	return aws.ToString(o.Image.ImageId.ImageDigest), nil
+}
+
+// immutableTagError explains PutImage failing because the tag is immutable and
+// already used, saying what it's used for if we can find out.
+func (c *copier) immutableTagError(ctx context.Context, destRepo, tag string, err error) error {
+
+	existing, lookupErr := c.destTagDigests(ctx, destRepo, []string{tag})
+	if lookupErr != nil || existing[tag] == "" {
+		return fmt.Errorf("tag %s already exists in %s, which has immutable tags, so it can't be changed: %w", tag, destRepo, err)
+	}
+
+	return fmt.Errorf("tag %s already points at %s in %s, which has immutable tags, so it can't be changed: %w", tag, existing[tag], destRepo, err)
+}
+
+// image is a manifest fetched from the source, along with everything needed to
+// copy it.  For an index, Config and Layers are empty and Children holds the
+// manifests it references.
+type image struct {
+	Digest     string
+	Unfiltered string // for an index filtered by platform, the source's digest for it
+	MediaType  string
+	Manifest   string
+	Config     imageLayer // with no Digest if there isn't one
+	Layers     []imageLayer
+	Children   []*image
+}
+
+// blobs returns the image's layers and config, which are all copied the same
+// way, in a new slice.
+func (img *image) blobs() []imageLayer {
+
+	blobs := make([]imageLayer, 0, len(img.Layers)+1)
+	blobs = append(blobs, img.Layers...)
+	if img.Config.Digest != "" {
+		blobs = append(blobs, img.Config)
+	}
+
+	return blobs
+}
+
+// allLayers returns the layers and configs of the image and any children,
+// without duplicates (platforms often share base layers).
+func (img *image) allLayers() []imageLayer {
+
+	seen := map[string]bool{}
+	var layers []imageLayer
+	for _, i := range append([]*image{img}, img.Children...) {
+		for _, l := range i.blobs() {
+			if seen[l.Digest] {
+				continue
+			}
+			seen[l.Digest] = true
+			layers = append(layers, l)
+		}
+	}
+
+	return layers
+}
+
+type manifest struct {
+	SchemaVersion int
+	MediaType     string
+	Config        imageLayer
+	Layers        []imageLayer
+	Manifests     []indexEntry // only in an index
+}
+
+type indexEntry struct {
+	MediaType string
+	Size      int64
+	Digest    string
+	Platform  platform
+}
+
+type platform struct {
+	Architecture string
+	OS           string
+	Variant      string
+}
+
+func (p platform) String() string {
+	s := p.OS + "/" + p.Architecture
+	if p.Variant != "" {
+		s += "/" + p.Variant
+	}
+	return s
+}
+
+// imageLayer is a descriptor of a layer or config.  For an OCI artifact (e.g.
+// a Helm chart) the config can be any media type, which doesn't matter since
+// it's copied like any other blob.
+type imageLayer struct {
+	MediaType string
+	Size      int64
+	Digest    string
+	URLs      []string // where a foreign layer's content is
+	Data      []byte   // the content itself, if it's embedded in the descriptor
+}
+
+// filterPlatforms cuts down the index to the children for c.platforms, and
+// rewrites its manifest to match, so it's a new index with a new digest.  The
+// other fields of the index and its entries are kept as they are.
+func (c *copier) filterPlatforms(img *image, m *manifest) error {
+
+	var raw map[string]json.RawMessage
+	err := json.Unmarshal([]byte(img.Manifest), &raw)
+	if err != nil {
+		return fmt.Errorf("Unmarshal index: %w", err)
+	}
+	var rawEntries []json.RawMessage
+	err = json.Unmarshal(raw["manifests"], &rawEntries)
+	if err != nil {
+		return fmt.Errorf("Unmarshal index manifests: %w", err)
+	}
+	if len(rawEntries) != len(m.Manifests) {
+		return fmt.Errorf("index has %d manifests, but %d were unmarshalled", len(rawEntries), len(m.Manifests))
+	}
+
+	var keptEntries []json.RawMessage
+	var kept []indexEntry
+	var all []string
+	for i, e := range m.Manifests {
+		all = append(all, e.Platform.String())
+		if c.wantPlatform(e.Platform) {
+			keptEntries = append(keptEntries, rawEntries[i])
+			kept = append(kept, e)
+		}
+	}
+	if len(kept) == 0 {
+		return fmt.Errorf("none of the platforms %s are in the index, which has %s", strings.Join(c.platforms, ", "), strings.Join(all, ", "))
+	}
+	if len(kept) == len(m.Manifests) {
+		return nil
+	}
+
+	raw["manifests"], err = marshalJSON(keptEntries)
+	if err != nil {
+		return err
+	}
+	manifestBytes, err := marshalJSON(raw)
+	if err != nil {
+		return err
+	}
+
+	c.log.Info("Filtered index by platform", "kept", len(kept), "of", len(m.Manifests))
+
+	sum := sha256.Sum256(manifestBytes)
+	img.Unfiltered = img.Digest
+	img.Digest = "sha256:" + hex.EncodeToString(sum[:])
+	img.Manifest = string(manifestBytes)
+	m.Manifests = kept
+
+	return nil
+}
+
+// marshalJSON is json.Marshal without escaping <, > and &, which would change
+// any annotations with them in.
+func marshalJSON(v any) ([]byte, error) {
+
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	enc.SetEscapeHTML(false)
+	err := enc.Encode(v)
+
+	return bytes.TrimSuffix(b.Bytes(), []byte("\n")), err
+}
+
+// wantPlatform is whether p is one of c.platforms, which are os/arch or
+// os/arch/variant.  Without a variant, any variant will do.
+func (c *copier) wantPlatform(p platform) bool {
+
+	for _, want := range c.platforms {
+		os, rest, _ := strings.Cut(want, "/")
+		arch, variant, _ := strings.Cut(rest, "/")
+		if os == p.OS && arch == p.Architecture && (variant == "" || variant == p.Variant) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// The empty descriptor is what OCI artifacts without a config use for it.  The
+// source registry may not have it as a blob, but there's no need to fetch it.
+const (
+	emptyDescriptorDigest  = "sha256:44136fa355b3678a1146ad16f7e8649e94fb4fc21fe77e8310c060f61caaff8a"
+	emptyDescriptorContent = "{}"
+)
+
+// content returns the layer's content if it's known without fetching it,
+// because it's embedded in the descriptor or it's the empty descriptor.
+func (l imageLayer) content() []byte {
+
+	switch {
+	case len(l.Data) > 0:
+		return l.Data
+	case l.Digest == emptyDescriptorDigest:
+		return []byte(emptyDescriptorContent)
+	}
+
+	return nil
+}
+
+// isForeign is whether the layer's content comes from somewhere other than the
+// registry (e.g. Windows base layers), so can't be copied and doesn't need to be.
+func (l imageLayer) isForeign() bool {
+	return l.MediaType == mediaTypeDockerForeignLayer || strings.HasPrefix(l.MediaType, mediaTypeOCINonDistributablePrefix)
+}
+
+const (
+	mediaTypeDockerManifestV1   = "application/vnd.docker.distribution.manifest.v1" // +json or +prettyjws
+	mediaTypeDockerManifest     = "application/vnd.docker.distribution.manifest.v2+json"
+	mediaTypeDockerManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+	mediaTypeOCIManifest        = "application/vnd.oci.image.manifest.v1+json"
+	mediaTypeOCIIndex           = "application/vnd.oci.image.index.v1+json"
+
+	mediaTypeDockerForeignLayer        = "application/vnd.docker.image.rootfs.foreign.diff.tar.gzip"
+	mediaTypeOCINonDistributablePrefix = "application/vnd.oci.image.layer.nondistributable."
+)
+
+// Without these ECR may convert what it returns to a single-platform manifest
+var acceptedMediaTypes = []string{
+	mediaTypeDockerManifest,
+	mediaTypeDockerManifestList,
+	mediaTypeOCIManifest,
+	mediaTypeOCIIndex,
+}
+
+func isIndex(mediaType string) bool {
+	return mediaType == mediaTypeDockerManifestList || mediaType == mediaTypeOCIIndex
+}
+
+var hexRe = regexp.MustCompile(`^[a-f0-9]{64}$`)
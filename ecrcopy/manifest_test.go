@@ -0,0 +1,83 @@
+package ecrcopy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+)
+
+// fakeSource has the one manifest, whatever's asked for.
+type fakeSource struct {
+	manifest  []byte
+	mediaType string
+}
+
+func (s fakeSource) fetchManifest(context.Context, string, string, string) ([]byte, string, string, error) {
+	return s.manifest, s.mediaType, fakeDigest(string(s.manifest)), nil
+}
+
+func (s fakeSource) blobRequest(context.Context, string, string) (*http.Request, error) {
+	panic("not faked")
+}
+
+func TestGetManifestSchema1(t *testing.T) {
+
+	schema1, err := os.ReadFile("testdata/schema1-manifest.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		src  fakeSource
+	}{
+		{"schemaVersion 1", fakeSource{manifest: schema1}},
+		{"signed media type", fakeSource{manifest: []byte(`{"name":"library/hello-world"}`), mediaType: mediaTypeDockerManifestV1 + "+prettyjws"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			c := newCopier(newFakeClient("111111111111"), Options{})
+			_, err := c.getManifest(context.Background(), tt.src, "app", "latest")
+			if want := "latest: unsupported manifest schema version 1"; err == nil || !strings.HasPrefix(err.Error(), want) {
+				t.Errorf("got error %v, want one starting %q", err, want)
+			}
+		})
+	}
+}
+
+func TestBlobsDontChangeLayers(t *testing.T) {
+
+	// Room for the config after the layers, which appending to them would use
+	backing := []imageLayer{{Digest: "layer1"}, {Digest: "layer2"}, {Digest: "spare"}}
+	img := &image{
+		Config: imageLayer{Digest: "config"},
+		Layers: backing[:2],
+	}
+	child := &image{
+		Config: imageLayer{Digest: "child config"},
+		Layers: backing[1:2],
+	}
+	img.Children = []*image{child}
+
+	blobs := img.blobs()
+	layers := img.allLayers()
+
+	var digests []string
+	for _, l := range backing {
+		digests = append(digests, l.Digest)
+	}
+	if got := fmt.Sprint(digests); got != "[layer1 layer2 spare]" {
+		t.Errorf("layers changed to %s", got)
+	}
+	if len(blobs) != 3 || blobs[2].Digest != "config" {
+		t.Errorf("got blobs %v, want the layers then the config", blobs)
+	}
+	if len(layers) != 4 {
+		t.Errorf("got %d layers, want 4", len(layers))
+	}
+}
@@ -0,0 +1,304 @@
+package ecrcopy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ecr"
+	"github.com/aws/aws-sdk-go-v2/service/ecr/types"
+	"github.com/aws/aws-sdk-go-v2/service/ecrpublic"
+	pubtypes "github.com/aws/aws-sdk-go-v2/service/ecrpublic/types"
+)
+
+// PublicRegistryHost is where ECR Public repositories are, as
+// public.ecr.aws/<registry alias>/<repository name>.
+const PublicRegistryHost = "public.ecr.aws"
+
+// errPublicUnsupported is for the parts of the ECR API that ECR Public hasn't
+// got.
+var errPublicUnsupported = errors.New("not supported by ECR Public")
+
+// NewPublicClient returns a Client for ECR Public, for copying to one of its
+// repositories, which are named without the registry alias.  The ecrpublic
+// client must be for us-east-1, which is the only region it's in.
+//
+// The ECR Public API has no way to get a manifest or download a layer, so to
+// copy from ECR Public use the public.ecr.aws/... name as the source repo,
+// which reads it with the registry API instead.  It can't scan images either,
+// and its repos have none of the settings in RepoSettings.
+func NewPublicClient(client *ecrpublic.Client) Client {
+	return publicClient{client}
+}
+
+// publicClient does the ECR calls with the ECR Public equivalents, converting
+// the errors the copy looks for into their ECR types.
+type publicClient struct {
+	c *ecrpublic.Client
+}
+
+// BatchGetImage only gets the image IDs, not their manifests, which is all
+// that's needed to know what tags in the destination point at.
+func (p publicClient) BatchGetImage(ctx context.Context, in *ecr.BatchGetImageInput, _ ...func(*ecr.Options)) (*ecr.BatchGetImageOutput, error) {
+
+	out := &ecr.BatchGetImageOutput{}
+	for _, id := range in.ImageIds {
+
+		// One at a time, since any that doesn't exist fails the whole call
+		o, err := p.c.DescribeImages(ctx, &ecrpublic.DescribeImagesInput{
+			RepositoryName: in.RepositoryName,
+			ImageIds:       []pubtypes.ImageIdentifier{{ImageDigest: id.ImageDigest, ImageTag: id.ImageTag}},
+		})
+		if isErr[*pubtypes.ImageNotFoundException](err) {
+			out.Failures = append(out.Failures, types.ImageFailure{ImageId: &id, FailureCode: types.ImageFailureCodeImageNotFound})
+			continue
+		}
+		if err != nil {
+			return nil, publicErr(err)
+		}
+
+		for _, d := range o.ImageDetails {
+			out.Images = append(out.Images, types.Image{
+				RepositoryName: in.RepositoryName,
+				ImageId:        &types.ImageIdentifier{ImageDigest: d.ImageDigest, ImageTag: id.ImageTag},
+			})
+		}
+	}
+
+	return out, nil
+}
+
+func (p publicClient) BatchCheckLayerAvailability(ctx context.Context, in *ecr.BatchCheckLayerAvailabilityInput, _ ...func(*ecr.Options)) (*ecr.BatchCheckLayerAvailabilityOutput, error) {
+
+	o, err := p.c.BatchCheckLayerAvailability(ctx, &ecrpublic.BatchCheckLayerAvailabilityInput{
+		RepositoryName: in.RepositoryName,
+		LayerDigests:   in.LayerDigests,
+	})
+	if err != nil {
+		return nil, publicErr(err)
+	}
+
+	out := &ecr.BatchCheckLayerAvailabilityOutput{}
+	for _, l := range o.Layers {
+		out.Layers = append(out.Layers, types.Layer{
+			LayerDigest:       l.LayerDigest,
+			LayerAvailability: types.LayerAvailability(l.LayerAvailability),
+			LayerSize:         l.LayerSize,
+			MediaType:         l.MediaType,
+		})
+	}
+	for _, f := range o.Failures {
+		out.Failures = append(out.Failures, types.LayerFailure{
+			LayerDigest:   f.LayerDigest,
+			FailureCode:   types.LayerFailureCode(f.FailureCode),
+			FailureReason: f.FailureReason,
+		})
+	}
+
+	return out, nil
+}
+
+func (p publicClient) GetDownloadUrlForLayer(context.Context, *ecr.GetDownloadUrlForLayerInput, ...func(*ecr.Options)) (*ecr.GetDownloadUrlForLayerOutput, error) {
+	return nil, fmt.Errorf("GetDownloadUrlForLayer: %w", errPublicUnsupported)
+}
+
+func (p publicClient) InitiateLayerUpload(ctx context.Context, in *ecr.InitiateLayerUploadInput, _ ...func(*ecr.Options)) (*ecr.InitiateLayerUploadOutput, error) {
+
+	o, err := p.c.InitiateLayerUpload(ctx, &ecrpublic.InitiateLayerUploadInput{
+		RepositoryName: in.RepositoryName,
+	})
+	if err != nil {
+		return nil, publicErr(err)
+	}
+
+	return &ecr.InitiateLayerUploadOutput{UploadId: o.UploadId, PartSize: o.PartSize}, nil
+}
+
+func (p publicClient) UploadLayerPart(ctx context.Context, in *ecr.UploadLayerPartInput, _ ...func(*ecr.Options)) (*ecr.UploadLayerPartOutput, error) {
+
+	o, err := p.c.UploadLayerPart(ctx, &ecrpublic.UploadLayerPartInput{
+		RepositoryName: in.RepositoryName,
+		UploadId:       in.UploadId,
+		PartFirstByte:  in.PartFirstByte,
+		PartLastByte:   in.PartLastByte,
+		LayerPartBlob:  in.LayerPartBlob,
+	})
+	if err != nil {
+		return nil, publicErr(err)
+	}
+
+	return &ecr.UploadLayerPartOutput{
+		RepositoryName:   o.RepositoryName,
+		UploadId:         o.UploadId,
+		LastByteReceived: o.LastByteReceived,
+	}, nil
+}
+
+func (p publicClient) CompleteLayerUpload(ctx context.Context, in *ecr.CompleteLayerUploadInput, _ ...func(*ecr.Options)) (*ecr.CompleteLayerUploadOutput, error) {
+
+	o, err := p.c.CompleteLayerUpload(ctx, &ecrpublic.CompleteLayerUploadInput{
+		RepositoryName: in.RepositoryName,
+		UploadId:       in.UploadId,
+		LayerDigests:   in.LayerDigests,
+	})
+	if err != nil {
+		return nil, publicErr(err)
+	}
+
+	return &ecr.CompleteLayerUploadOutput{
+		RepositoryName: o.RepositoryName,
+		UploadId:       o.UploadId,
+		LayerDigest:    o.LayerDigest,
+	}, nil
+}
+
+func (p publicClient) PutImage(ctx context.Context, in *ecr.PutImageInput, _ ...func(*ecr.Options)) (*ecr.PutImageOutput, error) {
+
+	o, err := p.c.PutImage(ctx, &ecrpublic.PutImageInput{
+		RepositoryName:         in.RepositoryName,
+		ImageManifest:          in.ImageManifest,
+		ImageManifestMediaType: in.ImageManifestMediaType,
+		ImageDigest:            in.ImageDigest,
+		ImageTag:               in.ImageTag,
+	})
+	if err != nil {
+		return nil, publicErr(err)
+	}
+
+	out := &ecr.PutImageOutput{Image: &types.Image{RepositoryName: in.RepositoryName}}
+	if o.Image != nil && o.Image.ImageId != nil {
+		out.Image.ImageId = &types.ImageIdentifier{ImageDigest: o.Image.ImageId.ImageDigest, ImageTag: o.Image.ImageId.ImageTag}
+	}
+
+	return out, nil
+}
+
+func (p publicClient) DescribeRepositories(ctx context.Context, in *ecr.DescribeRepositoriesInput, _ ...func(*ecr.Options)) (*ecr.DescribeRepositoriesOutput, error) {
+
+	o, err := p.c.DescribeRepositories(ctx, &ecrpublic.DescribeRepositoriesInput{
+		RepositoryNames: in.RepositoryNames,
+		NextToken:       in.NextToken,
+	})
+	if err != nil {
+		return nil, publicErr(err)
+	}
+
+	out := &ecr.DescribeRepositoriesOutput{NextToken: o.NextToken}
+	for _, r := range o.Repositories {
+		out.Repositories = append(out.Repositories, types.Repository{
+			RepositoryName: r.RepositoryName,
+			RepositoryUri:  r.RepositoryUri,
+			RepositoryArn:  r.RepositoryArn,
+			RegistryId:     r.RegistryId,
+		})
+	}
+
+	return out, nil
+}
+
+// CreateRepository makes a public repo with no catalog data, which can be
+// added later in the console.
+func (p publicClient) CreateRepository(ctx context.Context, in *ecr.CreateRepositoryInput, _ ...func(*ecr.Options)) (*ecr.CreateRepositoryOutput, error) {
+
+	o, err := p.c.CreateRepository(ctx, &ecrpublic.CreateRepositoryInput{
+		RepositoryName: in.RepositoryName,
+	})
+	if err != nil {
+		return nil, publicErr(err)
+	}
+
+	return &ecr.CreateRepositoryOutput{Repository: &types.Repository{
+		RepositoryName: o.Repository.RepositoryName,
+		RepositoryUri:  o.Repository.RepositoryUri,
+	}}, nil
+}
+
+func (p publicClient) BatchDeleteImage(ctx context.Context, in *ecr.BatchDeleteImageInput, _ ...func(*ecr.Options)) (*ecr.BatchDeleteImageOutput, error) {
+
+	input := &ecrpublic.BatchDeleteImageInput{RepositoryName: in.RepositoryName}
+	for _, id := range in.ImageIds {
+		input.ImageIds = append(input.ImageIds, pubtypes.ImageIdentifier{ImageDigest: id.ImageDigest, ImageTag: id.ImageTag})
+	}
+
+	o, err := p.c.BatchDeleteImage(ctx, input)
+	if err != nil {
+		return nil, publicErr(err)
+	}
+
+	out := &ecr.BatchDeleteImageOutput{}
+	for _, f := range o.Failures {
+		out.Failures = append(out.Failures, types.ImageFailure{
+			FailureCode:   types.ImageFailureCode(f.FailureCode),
+			FailureReason: f.FailureReason,
+		})
+	}
+
+	return out, nil
+}
+
+// ListImages lists the images' tags with DescribeImages, which is all ECR
+// Public has.  Of the filters, only TagStatusTagged is taken notice of.
+func (p publicClient) ListImages(ctx context.Context, in *ecr.ListImagesInput, _ ...func(*ecr.Options)) (*ecr.ListImagesOutput, error) {
+
+	o, err := p.c.DescribeImages(ctx, &ecrpublic.DescribeImagesInput{
+		RepositoryName: in.RepositoryName,
+		NextToken:      in.NextToken,
+	})
+	if err != nil {
+		return nil, publicErr(err)
+	}
+
+	tagged := in.Filter != nil && in.Filter.TagStatus == types.TagStatusTagged
+
+	out := &ecr.ListImagesOutput{NextToken: o.NextToken}
+	for _, d := range o.ImageDetails {
+		if len(d.ImageTags) == 0 && !tagged {
+			out.ImageIds = append(out.ImageIds, types.ImageIdentifier{ImageDigest: d.ImageDigest})
+		}
+		for _, tag := range d.ImageTags {
+			out.ImageIds = append(out.ImageIds, types.ImageIdentifier{ImageDigest: d.ImageDigest, ImageTag: aws.String(tag)})
+		}
+	}
+
+	return out, nil
+}
+
+func (p publicClient) StartImageScan(context.Context, *ecr.StartImageScanInput, ...func(*ecr.Options)) (*ecr.StartImageScanOutput, error) {
+	return nil, fmt.Errorf("StartImageScan: %w", errPublicUnsupported)
+}
+
+func (p publicClient) DescribeImageScanFindings(context.Context, *ecr.DescribeImageScanFindingsInput, ...func(*ecr.Options)) (*ecr.DescribeImageScanFindingsOutput, error) {
+	return nil, fmt.Errorf("DescribeImageScanFindings: %w", errPublicUnsupported)
+}
+
+// DescribeRegistry isn't supported, since there's no replication to ECR Public.
+func (p publicClient) DescribeRegistry(context.Context, *ecr.DescribeRegistryInput, ...func(*ecr.Options)) (*ecr.DescribeRegistryOutput, error) {
+	return nil, fmt.Errorf("DescribeRegistry: %w", errPublicUnsupported)
+}
+
+// publicErr converts the ECR Public errors the copy handles specially into
+// the ECR ones it looks for.  Anything else is left as it is.
+func publicErr(err error) error {
+
+	var apiErr interface{ ErrorMessage() string }
+	if !errors.As(err, &apiErr) {
+		return err
+	}
+	msg := aws.String(apiErr.ErrorMessage())
+
+	switch {
+	case isErr[*pubtypes.RepositoryNotFoundException](err):
+		return &types.RepositoryNotFoundException{Message: msg}
+	case isErr[*pubtypes.RepositoryAlreadyExistsException](err):
+		return &types.RepositoryAlreadyExistsException{Message: msg}
+	case isErr[*pubtypes.LayerAlreadyExistsException](err):
+		return &types.LayerAlreadyExistsException{Message: msg}
+	case isErr[*pubtypes.ImageAlreadyExistsException](err):
+		return &types.ImageAlreadyExistsException{Message: msg}
+	case isErr[*pubtypes.ImageTagAlreadyExistsException](err):
+		return &types.ImageTagAlreadyExistsException{Message: msg}
+	}
+
+	return err
+}
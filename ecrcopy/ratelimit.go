@@ -0,0 +1,93 @@
+package ecrcopy
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// maxRateBurst is how long a limited copy can go at full speed after it's
+// been idle, so it doesn't work out at less than the rate overall.
+const maxRateBurst = time.Second
+
+// rateLimiter is a token bucket shared by all the layer copies, so that
+// together they go no faster than the rate.  A nil one doesn't limit anything.
+type rateLimiter struct {
+	rate float64 // bytes a second
+
+	mu   sync.Mutex
+	next time.Time // when what's been let through so far is due at the rate
+}
+
+func newRateLimiter(bytesPerSecond int64) *rateLimiter {
+
+	if bytesPerSecond <= 0 {
+		return nil
+	}
+
+	return &rateLimiter{rate: float64(bytesPerSecond)}
+}
+
+// wait waits until n more bytes can go without going over the rate.
+func (l *rateLimiter) wait(ctx context.Context, n int) error {
+
+	if l == nil || n <= 0 {
+		return nil
+	}
+
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now.Add(-maxRateBurst)) {
+		l.next = now.Add(-maxRateBurst)
+	}
+	l.next = l.next.Add(time.Duration(float64(n) / l.rate * float64(time.Second)))
+	delay := l.next.Sub(now)
+	l.mu.Unlock()
+
+	if delay <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// reader returns r limited to the rate, along with everything else reading
+// through the limiter.
+func (l *rateLimiter) reader(ctx context.Context, r io.Reader) io.Reader {
+
+	if l == nil {
+		return r
+	}
+
+	return &limitedReader{ctx: ctx, r: r, l: l}
+}
+
+type limitedReader struct {
+	ctx context.Context
+	r   io.Reader
+	l   *rateLimiter
+}
+
+func (r *limitedReader) Read(p []byte) (int, error) {
+
+	// Small reads, so that waits are short and the copies take turns
+	if chunk := int(r.l.rate / 10); len(p) > chunk && chunk > 0 {
+		p = p[:chunk]
+	}
+
+	n, err := r.r.Read(p)
+	if waitErr := r.l.wait(r.ctx, n); waitErr != nil && err == nil {
+		err = waitErr
+	}
+
+	return n, err
+}
@@ -0,0 +1,276 @@
+package ecrcopy
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxManifestSize is how much of a manifest response we'll read, which is the
+// same limit as ECR and docker have.
+const maxManifestSize = 4 << 20
+
+// registrySource reads from a registry other than ECR with the OCI
+// distribution API, e.g. Docker Hub or GHCR.  It uses anonymous bearer tokens
+// when the registry asks for them, as it does even for public images.
+type registrySource struct {
+	client *http.Client
+
+	mu     sync.Mutex
+	tokens map[string]*registryToken // by host and repository name
+}
+
+// registryToken is a bearer token, and the WWW-Authenticate challenge it was
+// got for, so it can be got again when it expires.
+type registryToken struct {
+	token   string
+	expires time.Time
+	realm   string
+	service string
+	scope   string
+}
+
+func newRegistrySource(client *http.Client) *registrySource {
+	return &registrySource{client: client, tokens: map[string]*registryToken{}}
+}
+
+func (r *registrySource) fetchManifest(ctx context.Context, repo, digest, tag string) ([]byte, string, string, error) {
+
+	host, name, _ := splitRegistry(repo)
+	ref := digest
+	if ref == "" {
+		ref = tag
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("https://%s/v2/%s/manifests/%s", host, name, ref), nil)
+	if err != nil {
+		return nil, "", "", fmt.Errorf("http request for manifest %s: %w", ref, err)
+	}
+	req.Header.Set("Accept", strings.Join(acceptedMediaTypes, ", "))
+
+	resp, err := r.do(ctx, host, name, req)
+	if err != nil {
+		return nil, "", "", fmt.Errorf("http GET manifest %s: %w", ref, err)
+	}
+	defer resp.Body.Close()
+
+	manifestBytes, err := io.ReadAll(io.LimitReader(resp.Body, maxManifestSize+1))
+	if err != nil {
+		return nil, "", "", fmt.Errorf("http GET manifest %s: %w", ref, err)
+	}
+	if len(manifestBytes) > maxManifestSize {
+		return nil, "", "", fmt.Errorf("manifest %s is more than %d bytes", ref, maxManifestSize)
+	}
+
+	// The digest is of exactly what we got, which is what will be put in the
+	// destination, whatever the registry says it is.
+	sum := sha256.Sum256(manifestBytes)
+	manifestDigest := "sha256:" + hex.EncodeToString(sum[:])
+	if digest != "" && manifestDigest != digest {
+		return nil, "", "", fmt.Errorf("manifest %s has digest %s", digest, manifestDigest)
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+
+	return manifestBytes, mediaType, manifestDigest, nil
+}
+
+// blobRequest returns a request for the layer, with the token got for the
+// repository's manifest.  The registry may redirect it to a CDN, which the
+// http client doesn't send the token to.
+func (r *registrySource) blobRequest(ctx context.Context, repo, digest string) (*http.Request, error) {
+
+	host, name, _ := splitRegistry(repo)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("https://%s/v2/%s/blobs/%s", host, name, digest), nil)
+	if err != nil {
+		return nil, fmt.Errorf("http request for layer(%s): %w", digest, err)
+	}
+
+	err = r.authorize(ctx, host, name, req)
+	if err != nil {
+		return nil, err
+	}
+
+	return req, nil
+}
+
+// do sends the request, getting a token and trying again if the registry
+// wants one, and returns the response if it's a success.
+func (r *registrySource) do(ctx context.Context, host, name string, req *http.Request) (*http.Response, error) {
+
+	err := r.authorize(ctx, host, name, req)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode == http.StatusUnauthorized {
+		resp.Body.Close()
+
+		err = r.newToken(ctx, host, name, resp.Header.Get("WWW-Authenticate"))
+		if err != nil {
+			return nil, err
+		}
+		err = r.authorize(ctx, host, name, req)
+		if err != nil {
+			return nil, err
+		}
+
+		resp, err = r.client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, readStatusError(resp)
+	}
+
+	return resp, nil
+}
+
+// authorize adds the token for the repository to the request, if there is one,
+// getting a new one first if it's expired.
+func (r *registrySource) authorize(ctx context.Context, host, name string, req *http.Request) error {
+
+	r.mu.Lock()
+	t := r.tokens[host+"/"+name]
+	r.mu.Unlock()
+
+	if t == nil {
+		return nil
+	}
+
+	if time.Now().After(t.expires) {
+		var err error
+		t, err = r.fetchToken(ctx, host, name, t.realm, t.service, t.scope)
+		if err != nil {
+			return err
+		}
+	}
+
+	req.Header.Set("Authorization", "Bearer "+t.token)
+
+	return nil
+}
+
+// newToken gets a token as the WWW-Authenticate challenge says to.
+func (r *registrySource) newToken(ctx context.Context, host, name, challenge string) error {
+
+	scheme, params := parseChallenge(challenge)
+	if !strings.EqualFold(scheme, "Bearer") || params["realm"] == "" {
+		return fmt.Errorf("registry %s wants %q authentication, and only anonymous bearer tokens are supported", host, challenge)
+	}
+
+	scope := params["scope"]
+	if scope == "" {
+		scope = "repository:" + name + ":pull"
+	}
+
+	_, err := r.fetchToken(ctx, host, name, params["realm"], params["service"], scope)
+
+	return err
+}
+
+// fetchToken gets a token from the realm, and keeps it for the repository.
+func (r *registrySource) fetchToken(ctx context.Context, host, name, realm, service, scope string) (*registryToken, error) {
+
+	u, err := url.Parse(realm)
+	if err != nil {
+		return nil, fmt.Errorf("token realm %q: %w", realm, err)
+	}
+	q := u.Query()
+	if service != "" {
+		q.Set("service", service)
+	}
+	q.Set("scope", scope)
+	u.RawQuery = q.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("http request for token: %w", err)
+	}
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("http GET token from %s: %w", u.Host, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("http GET token from %s: %w", u.Host, readStatusError(resp))
+	}
+
+	var tokenResp struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&tokenResp)
+	if err != nil {
+		return nil, fmt.Errorf("token from %s: %w", u.Host, err)
+	}
+
+	t := &registryToken{
+		token:   tokenResp.Token,
+		realm:   realm,
+		service: service,
+		scope:   scope,
+	}
+	if t.token == "" {
+		t.token = tokenResp.AccessToken
+	}
+
+	// The spec says tokens last at least 60 seconds if it doesn't say, and we
+	// get a new one a little before it runs out.
+	expiresIn := time.Duration(max(tokenResp.ExpiresIn, 60)) * time.Second
+	t.expires = time.Now().Add(expiresIn - 10*time.Second)
+
+	r.mu.Lock()
+	r.tokens[host+"/"+name] = t
+	r.mu.Unlock()
+
+	return t, nil
+}
+
+// parseChallenge splits a WWW-Authenticate header such as
+//
+//	Bearer realm="https://auth.docker.io/token",service="registry.docker.io"
+//
+// into its scheme and parameters.
+func parseChallenge(h string) (scheme string, params map[string]string) {
+
+	scheme, rest, _ := strings.Cut(strings.TrimSpace(h), " ")
+	params = map[string]string{}
+
+	for {
+		rest = strings.TrimLeft(rest, " ,")
+		key, value, found := strings.Cut(rest, "=")
+		if !found {
+			return scheme, params
+		}
+
+		// A quoted value can have commas in it, e.g. a scope for several actions
+		if strings.HasPrefix(value, `"`) {
+			value, rest, _ = strings.Cut(value[1:], `"`)
+		} else {
+			value, rest, _ = strings.Cut(value, ",")
+		}
+
+		params[strings.ToLower(strings.TrimSpace(key))] = value
+	}
+}
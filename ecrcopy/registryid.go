@@ -0,0 +1,131 @@
+package ecrcopy
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ecr"
+)
+
+// NewRegistryClient returns a client for the registry of another account,
+// which the client's credentials are allowed to use by its repository
+// policies, by giving its ID in each call.
+func NewRegistryClient(client *ecr.Client, registryID string) Client {
+	return registryClient{Client: client, registryID: registryID}
+}
+
+// registryClient sets RegistryId on everything but DescribeRegistry, which is
+// only ever of the caller's own registry, so isn't of this one if it's another
+// account's.  registryIDOf says which it's for.
+type registryClient struct {
+	*ecr.Client
+	registryID string
+}
+
+func (c registryClient) BatchGetImage(ctx context.Context, in *ecr.BatchGetImageInput, opts ...func(*ecr.Options)) (*ecr.BatchGetImageOutput, error) {
+
+	input := *in
+	input.RegistryId = &c.registryID
+	return c.Client.BatchGetImage(ctx, &input, opts...)
+}
+
+func (c registryClient) BatchCheckLayerAvailability(ctx context.Context, in *ecr.BatchCheckLayerAvailabilityInput, opts ...func(*ecr.Options)) (*ecr.BatchCheckLayerAvailabilityOutput, error) {
+
+	input := *in
+	input.RegistryId = &c.registryID
+	return c.Client.BatchCheckLayerAvailability(ctx, &input, opts...)
+}
+
+func (c registryClient) GetDownloadUrlForLayer(ctx context.Context, in *ecr.GetDownloadUrlForLayerInput, opts ...func(*ecr.Options)) (*ecr.GetDownloadUrlForLayerOutput, error) {
+
+	input := *in
+	input.RegistryId = &c.registryID
+	return c.Client.GetDownloadUrlForLayer(ctx, &input, opts...)
+}
+
+func (c registryClient) InitiateLayerUpload(ctx context.Context, in *ecr.InitiateLayerUploadInput, opts ...func(*ecr.Options)) (*ecr.InitiateLayerUploadOutput, error) {
+
+	input := *in
+	input.RegistryId = &c.registryID
+	return c.Client.InitiateLayerUpload(ctx, &input, opts...)
+}
+
+func (c registryClient) UploadLayerPart(ctx context.Context, in *ecr.UploadLayerPartInput, opts ...func(*ecr.Options)) (*ecr.UploadLayerPartOutput, error) {
+
+	input := *in
+	input.RegistryId = &c.registryID
+	return c.Client.UploadLayerPart(ctx, &input, opts...)
+}
+
+func (c registryClient) CompleteLayerUpload(ctx context.Context, in *ecr.CompleteLayerUploadInput, opts ...func(*ecr.Options)) (*ecr.CompleteLayerUploadOutput, error) {
+
+	input := *in
+	input.RegistryId = &c.registryID
+	return c.Client.CompleteLayerUpload(ctx, &input, opts...)
+}
+
+func (c registryClient) PutImage(ctx context.Context, in *ecr.PutImageInput, opts ...func(*ecr.Options)) (*ecr.PutImageOutput, error) {
+
+	input := *in
+	input.RegistryId = &c.registryID
+	return c.Client.PutImage(ctx, &input, opts...)
+}
+
+func (c registryClient) DescribeRepositories(ctx context.Context, in *ecr.DescribeRepositoriesInput, opts ...func(*ecr.Options)) (*ecr.DescribeRepositoriesOutput, error) {
+
+	input := *in
+	input.RegistryId = &c.registryID
+	return c.Client.DescribeRepositories(ctx, &input, opts...)
+}
+
+func (c registryClient) CreateRepository(ctx context.Context, in *ecr.CreateRepositoryInput, opts ...func(*ecr.Options)) (*ecr.CreateRepositoryOutput, error) {
+
+	input := *in
+	input.RegistryId = &c.registryID
+	return c.Client.CreateRepository(ctx, &input, opts...)
+}
+
+func (c registryClient) BatchDeleteImage(ctx context.Context, in *ecr.BatchDeleteImageInput, opts ...func(*ecr.Options)) (*ecr.BatchDeleteImageOutput, error) {
+
+	input := *in
+	input.RegistryId = &c.registryID
+	return c.Client.BatchDeleteImage(ctx, &input, opts...)
+}
+
+func (c registryClient) ListImages(ctx context.Context, in *ecr.ListImagesInput, opts ...func(*ecr.Options)) (*ecr.ListImagesOutput, error) {
+
+	input := *in
+	input.RegistryId = &c.registryID
+	return c.Client.ListImages(ctx, &input, opts...)
+}
+
+func (c registryClient) StartImageScan(ctx context.Context, in *ecr.StartImageScanInput, opts ...func(*ecr.Options)) (*ecr.StartImageScanOutput, error) {
+
+	input := *in
+	input.RegistryId = &c.registryID
+	return c.Client.StartImageScan(ctx, &input, opts...)
+}
+
+func (c registryClient) DescribeImageScanFindings(ctx context.Context, in *ecr.DescribeImageScanFindingsInput, opts ...func(*ecr.Options)) (*ecr.DescribeImageScanFindingsOutput, error) {
+
+	input := *in
+	input.RegistryId = &c.registryID
+	return c.Client.DescribeImageScanFindings(ctx, &input, opts...)
+}
+
+// registryIDOf returns the ID of the registry the client is for, which unless
+// it's for another account's is the caller's own.
+func registryIDOf(ctx context.Context, client Client) (string, error) {
+
+	if r, ok := client.(registryClient); ok {
+		return r.registryID, nil
+	}
+
+	o, err := client.DescribeRegistry(ctx, &ecr.DescribeRegistryInput{})
+	if err != nil {
+		return "", fmt.Errorf("DescribeRegistry: %w", err)
+	}
+
+	return aws.ToString(o.RegistryId), nil
+}
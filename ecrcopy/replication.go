@@ -0,0 +1,179 @@
+package ecrcopy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ecr"
+	"github.com/aws/aws-sdk-go-v2/service/ecr/types"
+)
+
+const (
+	replicationPollInterval = 10 * time.Second
+	defaultReplicationWait  = 10 * time.Minute
+)
+
+// replicated is whether the image gets replicated to the destination by one
+// of the source registry's replication rules, and if so waits up to wait for
+// it to get there.  If it doesn't, or anything about it can't be found out,
+// that's logged and it's copied after all.
+//
+// Replication keeps the repo name and the tags, so it only applies when they
+// stay the same.
+func (c *copier) replicated(ctx context.Context, srcRepo, ref, dstRepo string, tags []string, wait time.Duration, result *Result) (bool, error) {
+
+	digest, tag, err := parseRef(ref)
+	if err != nil {
+		return false, err
+	}
+
+	if _, _, ok := splitRegistry(srcRepo); ok || srcRepo != dstRepo || len(tags) > 1 || (len(tags) == 1 && tags[0] != tag) {
+		c.log.Debug("Replication can't make this copy", "from", srcRepo, "to", dstRepo, "tags", tags)
+		return false, nil
+	}
+
+	covered, err := c.replicationCovers(ctx, srcRepo)
+	if err != nil {
+		if ctx.Err() != nil {
+			return false, err
+		}
+		c.log.Warn("Can't tell if the image is replicated, so copying it", "error", err)
+		return false, nil
+	}
+	if !covered {
+		c.log.Info("No replication rule covers the copy", "repo", srcRepo)
+		return false, nil
+	}
+
+	_, _, srcDigest, err := ecrSource{c.src}.fetchManifest(ctx, srcRepo, digest, tag)
+	if err != nil {
+		return false, err
+	}
+	result.SourceDigest = srcDigest
+
+	if c.dryRun {
+		c.log.Info("Would wait for replication", "repo", srcRepo, "digest", srcDigest)
+		return true, nil
+	}
+
+	if wait <= 0 {
+		wait = defaultReplicationWait
+	}
+	c.log.Info("Waiting for replication", "repo", srcRepo, "digest", srcDigest, "wait", wait)
+
+	waitCtx, cancel := context.WithTimeout(ctx, wait)
+	defer cancel()
+
+	imageID := types.ImageIdentifier{ImageDigest: &srcDigest}
+	if tag != "" {
+		imageID = types.ImageIdentifier{ImageTag: &tag}
+	}
+
+	for {
+		o, err := c.dst.BatchGetImage(waitCtx, &ecr.BatchGetImageInput{
+			RepositoryName:     &dstRepo,
+			ImageIds:           []types.ImageIdentifier{imageID},
+			AcceptedMediaTypes: acceptedMediaTypes,
+		})
+		switch {
+		case err == nil && len(o.Images) == 1 && aws.ToString(o.Images[0].ImageId.ImageDigest) == srcDigest:
+			c.log.Info("Replicated", "repo", dstRepo, "digest", srcDigest)
+			result.DestDigest = srcDigest
+			return true, nil
+
+		case errors.Is(waitCtx.Err(), context.DeadlineExceeded) && ctx.Err() == nil:
+			c.log.Warn("Image wasn't replicated in time, so copying it", "repo", dstRepo, "digest", srcDigest, "waited", wait)
+			return false, nil
+
+		case ctx.Err() != nil:
+			return false, ctx.Err()
+
+		case err != nil && !isErr[*types.RepositoryNotFoundException](err):
+			// It not being there yet is expected, but anything else isn't
+			c.log.Warn("Can't check for the replicated image, so copying it", "error", err)
+			return false, nil
+		}
+
+		select {
+		case <-waitCtx.Done():
+		case <-time.After(replicationPollInterval):
+		}
+	}
+}
+
+// replicationCovers is whether one of the source registry's replication rules
+// copies repo to the destination's registry and region.  The source has to be
+// the caller's own registry, since another account's rules can't be read.
+func (c *copier) replicationCovers(ctx context.Context, repo string) (bool, error) {
+
+	dstRegion, srcRegion := regionOf(c.dst), regionOf(c.src)
+	if dstRegion == "" {
+		return false, errors.New("the destination's region isn't known")
+	}
+
+	dstRegistry, err := registryIDOf(ctx, c.dst)
+	if err != nil {
+		return false, err
+	}
+	src, err := c.src.DescribeRegistry(ctx, &ecr.DescribeRegistryInput{})
+	if err != nil {
+		return false, err
+	}
+
+	// The rules can only be got for the caller's own registry
+	srcRegistry := aws.ToString(src.RegistryId)
+	if r, ok := c.src.(registryClient); ok && r.registryID != srcRegistry {
+		return false, fmt.Errorf("the replication rules of %s's registry can't be read from another account", r.registryID)
+	}
+
+	if dstRegistry == srcRegistry && dstRegion == srcRegion {
+		return false, nil // nothing replicates to itself
+	}
+	if src.ReplicationConfiguration == nil {
+		return false, nil
+	}
+
+	for _, rule := range src.ReplicationConfiguration.Rules {
+		if !matchesFilters(repo, rule.RepositoryFilters) {
+			continue
+		}
+		for _, d := range rule.Destinations {
+			if aws.ToString(d.RegistryId) == dstRegistry && aws.ToString(d.Region) == dstRegion {
+				return true, nil
+			}
+		}
+	}
+
+	return false, nil
+}
+
+// matchesFilters is whether a replication rule with the filters applies to the
+// repo, which it does to every repo if there aren't any.
+func matchesFilters(repo string, filters []types.RepositoryFilter) bool {
+
+	if len(filters) == 0 {
+		return true
+	}
+
+	for _, f := range filters {
+		if f.FilterType == types.RepositoryFilterTypePrefixMatch && strings.HasPrefix(repo, aws.ToString(f.Filter)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// regionOf returns the client's region, if it's an *ecr.Client.
+func regionOf(client Client) string {
+
+	if c, ok := client.(interface{ Options() ecr.Options }); ok {
+		return c.Options().Region
+	}
+
+	return ""
+}
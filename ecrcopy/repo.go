@@ -0,0 +1,296 @@
+package ecrcopy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ecr"
+	"github.com/aws/aws-sdk-go-v2/service/ecr/types"
+)
+
+// RepoSettings are what a repo made by Options.CreateRepo is created with.
+type RepoSettings struct {
+	ImageTagMutability types.ImageTagMutability // empty for ECR's default
+	ScanOnPush         bool
+}
+
+// ensureRepo creates the destination repo if it doesn't already exist.  It's
+// fine if something else creates it at the same time.
+func (c *copier) ensureRepo(ctx context.Context, destRepo string, settings RepoSettings) error {
+
+	_, err := c.dst.DescribeRepositories(ctx, &ecr.DescribeRepositoriesInput{
+		RepositoryNames: []string{destRepo},
+	})
+	if err == nil {
+		return nil
+	}
+	if !isErr[*types.RepositoryNotFoundException](err) {
+		return fmt.Errorf("DescribeRepositories: %w", err)
+	}
+
+	input := &ecr.CreateRepositoryInput{
+		RepositoryName: &destRepo,
+		ImageScanningConfiguration: &types.ImageScanningConfiguration{
+			ScanOnPush: settings.ScanOnPush,
+		},
+		ImageTagMutability: settings.ImageTagMutability,
+	}
+	if c.kmsKey != "" {
+		input.EncryptionConfiguration = &types.EncryptionConfiguration{
+			EncryptionType: types.EncryptionTypeKms,
+			KmsKey:         &c.kmsKey,
+		}
+	}
+
+	o, err := c.dst.CreateRepository(ctx, input)
+	if err != nil {
+		if isErr[*types.RepositoryAlreadyExistsException](err) {
+			c.log.Info("Repository was created by someone else", "repo", destRepo)
+			return nil
+		}
+		return fmt.Errorf("CreateRepository: %w", err)
+	}
+
+	c.log.Info("Created repository", "uri", aws.ToString(o.Repository.RepositoryUri))
+
+	return nil
+}
+
+// checkEncryption checks the destination repo is encrypted with c.kmsKey, or
+// with KMS at all if that's not set, and fails if it isn't and c.requireKMS,
+// or otherwise warns.
+func (c *copier) checkEncryption(ctx context.Context, destRepo string) error {
+
+	o, err := c.dst.DescribeRepositories(ctx, &ecr.DescribeRepositoriesInput{
+		RepositoryNames: []string{destRepo},
+	})
+	if err != nil {
+		if c.dryRun && c.createRepo != nil && isErr[*types.RepositoryNotFoundException](err) {
+			return nil // it'd be created with the key
+		}
+		return fmt.Errorf("DescribeRepositories: %w", err)
+	}
+	if len(o.Repositories) != 1 {
+		return fmt.Errorf("DescribeRepositories: Got %d Repositories", len(o.Repositories))
+	}
+
+	// No configuration is ECR's default
+	encryption, key := types.EncryptionTypeAes256, ""
+	if ec := o.Repositories[0].EncryptionConfiguration; ec != nil {
+		encryption, key = ec.EncryptionType, aws.ToString(ec.KmsKey)
+	}
+
+	c.log.Debug("Destination encryption", "repo", destRepo, "type", encryption, "key", key)
+
+	var problem string
+	switch {
+	case encryption != types.EncryptionTypeKms && encryption != types.EncryptionTypeKmsDsse:
+		problem = fmt.Sprintf("%s is encrypted with %s, not KMS", destRepo, encryption)
+	case c.kmsKey != "" && key != c.kmsKey && !strings.HasSuffix(key, ":key/"+c.kmsKey):
+		problem = fmt.Sprintf("%s is encrypted with KMS key %s, not %s", destRepo, key, c.kmsKey)
+	default:
+		return nil
+	}
+
+	if c.requireKMS {
+		return errors.New(problem)
+	}
+	c.log.Warn("Destination repo isn't encrypted as expected", "problem", problem)
+
+	return nil
+}
+
+// taggedImage is an image in a repo, and its tags.
+type taggedImage struct {
+	Digest string
+	Tags   []string
+}
+
+// listTagged returns the tagged images in the source repo, in the order they're
+// listed.
+func (c *copier) listTagged(ctx context.Context, repo string) ([]*taggedImage, error) {
+
+	input := &ecr.ListImagesInput{
+		RepositoryName: &repo,
+		Filter: &types.ListImagesFilter{
+			TagStatus: types.TagStatusTagged,
+		},
+	}
+
+	var images []*taggedImage
+	byDigest := map[string]*taggedImage{}
+
+	for {
+		o, err := c.src.ListImages(ctx, input)
+		if err != nil {
+			return nil, fmt.Errorf("ListImages: %w", err)
+		}
+
+		for _, id := range o.ImageIds {
+			digest := aws.ToString(id.ImageDigest)
+			ti := byDigest[digest]
+			if ti == nil {
+				ti = &taggedImage{Digest: digest}
+				byDigest[digest] = ti
+				images = append(images, ti)
+			}
+			ti.Tags = append(ti.Tags, aws.ToString(id.ImageTag))
+		}
+
+		if o.NextToken == nil {
+			break
+		}
+		input.NextToken = o.NextToken
+	}
+
+	return images, nil
+}
+
+// deleteSource deletes the image with the given digest from the source repo.
+// It's by digest, rather than the tag that was copied, so that it's definitely
+// the image that was copied, even if the tag has been moved since.
+func (c *copier) deleteSource(ctx context.Context, srcRepo, digest string) error {
+
+	if c.dryRun {
+		c.log.Info("Would delete source image", "repo", srcRepo, "digest", digest)
+		return nil
+	}
+
+	o, err := c.src.BatchDeleteImage(ctx, &ecr.BatchDeleteImageInput{
+		RepositoryName: &srcRepo,
+		ImageIds:       []types.ImageIdentifier{{ImageDigest: &digest}},
+	})
+	if err != nil {
+		return fmt.Errorf("BatchDeleteImage: %w", err)
+	}
+	if len(o.Failures) > 0 {
+		f := o.Failures[0]
+		return fmt.Errorf("BatchDeleteImage %s: %s: %s", digest, f.FailureCode, aws.ToString(f.FailureReason))
+	}
+
+	c.log.Info("Deleted source image", "repo", srcRepo, "digest", digest)
+
+	return nil
+}
+
+// destTagDigests returns the digests of those of the tags which exist in the
+// destination repo.
+func (c *copier) destTagDigests(ctx context.Context, dstRepo string, tags []string) (map[string]string, error) {
+
+	input := &ecr.BatchGetImageInput{
+		RepositoryName:     &dstRepo,
+		AcceptedMediaTypes: acceptedMediaTypes,
+	}
+	for _, tag := range tags {
+		input.ImageIds = append(input.ImageIds, types.ImageIdentifier{ImageTag: aws.String(tag)})
+	}
+
+	// The ones that don't exist come back as failures
+	o, err := c.dst.BatchGetImage(ctx, input)
+	if err != nil {
+		return nil, fmt.Errorf("BatchGetImage: %w", err)
+	}
+
+	digests := map[string]string{}
+	for _, img := range o.Images {
+		digests[aws.ToString(img.ImageId.ImageTag)] = aws.ToString(img.ImageId.ImageDigest)
+	}
+
+	return digests, nil
+}
+
+// upToDate is whether each of the tags in the destination repo is already the
+// image the ref is in the source, so there's nothing to copy, and returns the
+// digests of it in each.  The manifests are compared without their whitespace,
+// which changes the digest but not the image.
+func (c *copier) upToDate(ctx context.Context, srcRepo, ref, dstRepo string, tags []string) (srcDigest, dstDigest string, ok bool, err error) {
+
+	digest, tag, err := parseRef(ref)
+	if err != nil {
+		return "", "", false, err
+	}
+
+	srcManifest, _, srcDigest, err := c.sourceFor(srcRepo).fetchManifest(ctx, srcRepo, digest, tag)
+	if err != nil {
+		return "", "", false, err
+	}
+
+	input := &ecr.BatchGetImageInput{
+		RepositoryName:     &dstRepo,
+		AcceptedMediaTypes: acceptedMediaTypes,
+	}
+	for _, tag := range tags {
+		input.ImageIds = append(input.ImageIds, types.ImageIdentifier{ImageTag: aws.String(tag)})
+	}
+
+	o, err := c.dst.BatchGetImage(ctx, input)
+	if isErr[*types.RepositoryNotFoundException](err) {
+		return "", "", false, nil
+	}
+	if err != nil {
+		return "", "", false, fmt.Errorf("BatchGetImage: %w", err)
+	}
+
+	// Tags that aren't there come back as failures
+	if len(o.Failures) > 0 || len(o.Images) != len(tags) {
+		return "", "", false, nil
+	}
+
+	for _, img := range o.Images {
+		if aws.ToString(img.ImageId.ImageDigest) == srcDigest {
+			continue
+		}
+		if img.ImageManifest == nil || !sameManifest(srcManifest, []byte(*img.ImageManifest)) {
+			return "", "", false, nil
+		}
+	}
+
+	return srcDigest, aws.ToString(o.Images[0].ImageId.ImageDigest), true, nil
+}
+
+// sameManifest is whether the manifests are the same apart from whitespace.
+func sameManifest(a, b []byte) bool {
+
+	var compactA, compactB bytes.Buffer
+	if json.Compact(&compactA, a) != nil || json.Compact(&compactB, b) != nil {
+		return false
+	}
+
+	return bytes.Equal(compactA.Bytes(), compactB.Bytes())
+}
+
+// checkOverwrite fails if any of the tags are already in the destination repo
+// and it has immutable tags, so the copy couldn't be given them.
+func (c *copier) checkOverwrite(ctx context.Context, dstRepo string, tags []string) error {
+
+	o, err := c.dst.DescribeRepositories(ctx, &ecr.DescribeRepositoriesInput{
+		RepositoryNames: []string{dstRepo},
+	})
+	if err != nil {
+		if isErr[*types.RepositoryNotFoundException](err) {
+			return nil // so nothing to overwrite
+		}
+		return fmt.Errorf("DescribeRepositories: %w", err)
+	}
+
+	if len(o.Repositories) == 0 || o.Repositories[0].ImageTagMutability != types.ImageTagMutabilityImmutable || len(tags) == 0 {
+		return nil
+	}
+
+	existing, err := c.destTagDigests(ctx, dstRepo, tags)
+	if err != nil {
+		return err
+	}
+	for _, tag := range tags {
+		if digest, ok := existing[tag]; ok {
+			return fmt.Errorf("can't overwrite %s:%s, which points at %s, because %s has immutable tags", dstRepo, tag, digest, dstRepo)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,120 @@
+package ecrcopy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/smithy-go"
+)
+
+const (
+	retryBaseDelay = 500 * time.Millisecond
+	retryMaxDelay  = 30 * time.Second
+)
+
+// retry calls fn until it succeeds, fails in a way that isn't worth retrying,
+// or has been retried c.maxRetries times.  Between attempts it backs off
+// exponentially, with jitter so concurrent copies don't retry in lock step.
+func (c *copier) retry(ctx context.Context, what string, fn func() error) error {
+
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		if err == nil || attempt >= c.maxRetries || !isRetryable(err) {
+			return err
+		}
+
+		delay := backoff(attempt)
+		c.log.Warn("Retrying", "call", what, "delay", delay, "error", err)
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+	}
+}
+
+// backoff is how long to wait before retry number attempt (from 0).  It's
+// somewhere between half and all of the exponential delay.
+func backoff(attempt int) time.Duration {
+
+	d := retryBaseDelay << attempt
+	if d > retryMaxDelay || d <= 0 {
+		d = retryMaxDelay
+	}
+
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// isRetryable is whether err is throttling, a server side error, or a network
+// problem, any of which might go away if we try again.
+func isRetryable(err error) bool {
+
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	var respErr *awshttp.ResponseError
+	if errors.As(err, &respErr) && respErr.HTTPStatusCode() >= 500 {
+		return true
+	}
+
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		switch apiErr.ErrorCode() {
+		case "ThrottlingException", "TooManyRequestsException", "ThrottledException", "RequestLimitExceeded", "ServerException":
+			return true
+		}
+		return false
+	}
+
+	var statusErr httpStatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode >= 500
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// httpStatusError is an unsuccessful HTTP response.
+type httpStatusError struct {
+	StatusCode int
+	Status     string
+	Body       string // the start of it, which usually says what's wrong
+}
+
+// maxErrorBody is how much of an error response's body goes in the error.
+const maxErrorBody = 1024
+
+// readStatusError returns an error for the response's status, with the start
+// of its body, and closes the body.
+func readStatusError(resp *http.Response) httpStatusError {
+
+	defer resp.Body.Close()
+
+	b, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBody))
+
+	return httpStatusError{StatusCode: resp.StatusCode, Status: resp.Status, Body: strings.TrimSpace(string(b))}
+}
+
+// HTTPStatusCode is the same as the AWS SDK's response errors have, so callers
+// can look at it without knowing which it is.
+func (e httpStatusError) HTTPStatusCode() int {
+	return e.StatusCode
+}
+
+func (e httpStatusError) Error() string {
+	if e.Body == "" {
+		return fmt.Sprintf("http status %s", e.Status)
+	}
+	return fmt.Sprintf("http status %s: %s", e.Status, e.Body)
+}
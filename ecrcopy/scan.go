@@ -0,0 +1,122 @@
+package ecrcopy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ecr"
+	"github.com/aws/aws-sdk-go-v2/service/ecr/types"
+)
+
+const (
+	scanPollInterval = 5 * time.Second
+	scanWaitMax      = 15 * time.Minute
+)
+
+// Result.ScanStatus values, other than ECR's own scan statuses.
+const (
+	ScanStarted     = "STARTED"     // and not waited for
+	ScanUnavailable = "UNAVAILABLE" // the image couldn't be scanned
+	ScanTimedOut    = "TIMED_OUT"   // it didn't finish within the wait
+)
+
+// scan starts a basic scan of the image in the destination, unless the repo
+// scans on push so one will have started already, and if wait is set waits
+// for it to finish and puts the counts of findings in result.
+//
+// The image has been copied by now, so a scan that can't be done (e.g. the
+// registry uses enhanced scanning, or the image has been scanned in the last
+// day) is logged and noted in result rather than being an error.
+func (c *copier) scan(ctx context.Context, dstRepo, digest string, wait bool, result *Result) error {
+
+	imageID := &types.ImageIdentifier{ImageDigest: &digest}
+
+	scanOnPush, err := c.scansOnPush(ctx, dstRepo)
+	if err != nil {
+		return err
+	}
+
+	if !scanOnPush {
+		_, err = c.dst.StartImageScan(ctx, &ecr.StartImageScanInput{
+			RepositoryName: &dstRepo,
+			ImageId:        imageID,
+		})
+		if err != nil {
+			if ctx.Err() != nil {
+				return fmt.Errorf("StartImageScan: %w", err)
+			}
+			c.log.Warn("Can't scan image", "digest", digest, "error", err)
+			result.ScanStatus = ScanUnavailable
+			return nil
+		}
+		c.log.Info("Started scan", "digest", digest)
+	}
+
+	result.ScanStatus = ScanStarted
+	if !wait {
+		return nil
+	}
+
+	waitCtx, cancel := context.WithTimeout(ctx, scanWaitMax)
+	defer cancel()
+
+	for {
+		o, err := c.dst.DescribeImageScanFindings(waitCtx, &ecr.DescribeImageScanFindingsInput{
+			RepositoryName: &dstRepo,
+			ImageId:        imageID,
+		})
+		switch {
+		case err == nil && o.ImageScanStatus != nil && o.ImageScanStatus.Status != types.ScanStatusInProgress && o.ImageScanStatus.Status != types.ScanStatusPending:
+			result.ScanStatus = string(o.ImageScanStatus.Status)
+			if o.ImageScanStatus.Status != types.ScanStatusComplete {
+				c.log.Warn("Scan didn't complete", "digest", digest, "status", o.ImageScanStatus.Status, "description", aws.ToString(o.ImageScanStatus.Description))
+				return nil
+			}
+			result.ScanFindings = map[string]int32{}
+			if o.ImageScanFindings != nil {
+				result.ScanFindings = o.ImageScanFindings.FindingSeverityCounts
+			}
+			return nil
+
+		case errors.Is(waitCtx.Err(), context.DeadlineExceeded) && ctx.Err() == nil:
+			c.log.Warn("Scan didn't finish in time", "digest", digest, "waited", scanWaitMax)
+			result.ScanStatus = ScanTimedOut
+			return nil
+
+		case err != nil && ctx.Err() != nil:
+			return fmt.Errorf("DescribeImageScanFindings: %w", err)
+
+		case err != nil && !isErr[*types.ScanNotFoundException](err):
+			// It not being there is expected for a bit after the push, for a
+			// scan on push, but anything else isn't
+			c.log.Warn("Can't get scan findings", "digest", digest, "error", err)
+			result.ScanStatus = ScanUnavailable
+			return nil
+		}
+
+		select {
+		case <-waitCtx.Done():
+		case <-time.After(scanPollInterval):
+		}
+	}
+}
+
+// scansOnPush is whether the repo is set to scan images when they're pushed.
+func (c *copier) scansOnPush(ctx context.Context, repo string) (bool, error) {
+
+	o, err := c.dst.DescribeRepositories(ctx, &ecr.DescribeRepositoriesInput{
+		RepositoryNames: []string{repo},
+	})
+	if err != nil {
+		return false, fmt.Errorf("DescribeRepositories: %w", err)
+	}
+
+	if len(o.Repositories) != 1 || o.Repositories[0].ImageScanningConfiguration == nil {
+		return false, nil
+	}
+
+	return o.Repositories[0].ImageScanningConfiguration.ScanOnPush, nil
+}
@@ -0,0 +1,68 @@
+package ecrcopy
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ecr"
+	"github.com/aws/aws-sdk-go-v2/service/ecr/types"
+)
+
+// signatureSuffixes are the tag suffixes cosign uses for what it stores about
+// an image, in tags named after the image digest.
+var signatureSuffixes = []string{".sig", ".att", ".sbom"}
+
+// copySignatures copies any signatures, attestations and SBOMs for the image
+// with the given digest, keeping their tags, and adds them to result.
+func (c *copier) copySignatures(ctx context.Context, srcRepo, digest, dstRepo string, result *Result) error {
+
+	tags, err := c.findSignatures(ctx, srcRepo, digest)
+	if err != nil {
+		return err
+	}
+
+	for _, tag := range tags {
+		c.log.Info("Copying signature", "repo", srcRepo, "tag", tag)
+
+		sigResult := &Result{}
+		err = c.copyImage(ctx, srcRepo, tag, dstRepo, []string{tag}, sigResult)
+		if err != nil {
+			return fmt.Errorf("signature %s: %w", tag, err)
+		}
+		result.add(sigResult)
+		result.Signatures++
+	}
+
+	return nil
+}
+
+// findSignatures returns the tags in the source repo of signatures etc. of the
+// image with the given digest.
+func (c *copier) findSignatures(ctx context.Context, srcRepo, digest string) ([]string, error) {
+
+	// sha256:abc... is tagged as sha256-abc....sig
+	prefix := strings.Replace(digest, ":", "-", 1)
+
+	input := &ecr.BatchGetImageInput{
+		RepositoryName:     &srcRepo,
+		AcceptedMediaTypes: acceptedMediaTypes,
+	}
+	for _, suffix := range signatureSuffixes {
+		input.ImageIds = append(input.ImageIds, types.ImageIdentifier{ImageTag: aws.String(prefix + suffix)})
+	}
+
+	// The ones that don't exist come back as failures
+	o, err := c.src.BatchGetImage(ctx, input)
+	if err != nil {
+		return nil, fmt.Errorf("BatchGetImage signatures: %w", err)
+	}
+
+	var tags []string
+	for _, img := range o.Images {
+		tags = append(tags, aws.ToString(img.ImageId.ImageTag))
+	}
+
+	return tags, nil
+}
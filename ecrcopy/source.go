@@ -0,0 +1,110 @@
+package ecrcopy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ecr"
+	"github.com/aws/aws-sdk-go-v2/service/ecr/types"
+)
+
+// source is where images are read from: ECR, or another registry.  Only the
+// manifests and layer content come from it; everything else is ECR.
+type source interface {
+
+	// fetchManifest returns the manifest with the digest, or if that's empty
+	// the tag, along with its media type if known apart from the manifest
+	// itself, and its digest.
+	fetchManifest(ctx context.Context, repo, digest, tag string) (manifest []byte, mediaType, manifestDigest string, err error)
+
+	// blobRequest returns a GET request for the layer's content.
+	blobRequest(ctx context.Context, repo, digest string) (*http.Request, error)
+}
+
+// sourceFor returns the source to read repo from, which is ECR unless it looks
+// like a reference to another registry, i.e. the first part of it is a host
+// name such as docker.io or ghcr.io.
+func (c *copier) sourceFor(repo string) source {
+
+	if _, _, ok := splitRegistry(repo); ok {
+		return c.registry
+	}
+
+	return ecrSource{c.src}
+}
+
+// splitRegistry splits a reference to another registry into its host and the
+// repository name there.  Like docker, it takes the first part of the
+// reference to be a host if it has a dot or a colon in it, or is localhost.
+func splitRegistry(repo string) (host, name string, ok bool) {
+
+	host, name, found := strings.Cut(repo, "/")
+	if !found || !(strings.ContainsAny(host, ".:") || host == "localhost") {
+		return "", "", false
+	}
+
+	if host == "docker.io" {
+		host = "registry-1.docker.io"
+		if !strings.Contains(name, "/") {
+			name = "library/" + name
+		}
+	}
+
+	return host, name, true
+}
+
+// ecrSource reads from ECR.
+type ecrSource struct {
+	client Client
+}
+
+func (s ecrSource) fetchManifest(ctx context.Context, repo, digest, tag string) ([]byte, string, string, error) {
+
+	input := &ecr.BatchGetImageInput{
+		RepositoryName:     &repo,
+		ImageIds:           []types.ImageIdentifier{{}},
+		AcceptedMediaTypes: acceptedMediaTypes,
+	}
+	if digest != "" {
+		input.ImageIds[0].ImageDigest = &digest
+	} else {
+		input.ImageIds[0].ImageTag = &tag
+	}
+
+	img, err := s.client.BatchGetImage(ctx, input)
+	if err != nil {
+		return nil, "", "", fmt.Errorf("BatchGetImage: %w", err)
+	}
+
+	if len(img.Images) != 1 {
+		return nil, "", "", fmt.Errorf("BatchGetImage: Got %d Images", len(img.Images))
+	}
+
+	return []byte(aws.ToString(img.Images[0].ImageManifest)),
+		aws.ToString(img.Images[0].ImageManifestMediaType),
+		aws.ToString(img.Images[0].ImageId.ImageDigest),
+		nil
+}
+
+// blobRequest gets a URL for the layer from ECR.  It's presigned, so needs no
+// credentials, but it expires, so has to be got afresh for each request.
+func (s ecrSource) blobRequest(ctx context.Context, repo, digest string) (*http.Request, error) {
+
+	dlUrl, err := s.client.GetDownloadUrlForLayer(ctx, &ecr.GetDownloadUrlForLayerInput{
+		RepositoryName: &repo,
+		LayerDigest:    &digest,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("GetDownloadUrlForLayer(%s): %w", digest, err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, *dlUrl.DownloadUrl, nil)
+	if err != nil {
+		return nil, fmt.Errorf("http request for layer(%s): %w", digest, err)
+	}
+
+	return req, nil
+}
@@ -0,0 +1,201 @@
+package ecrcopy
+
+import (
+	"crypto/sha256"
+	"encoding"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/service/ecr"
+)
+
+// stateFile keeps track of layer uploads in progress on disk, so that if a
+// copy is interrupted, a later one can carry on with an upload from where it
+// got to rather than starting a big layer again.  A nil *stateFile keeps
+// nothing.
+type stateFile struct {
+	path string
+
+	mu      sync.Mutex
+	loaded  bool
+	uploads map[string]*uploadState // by destination repo and layer digest
+}
+
+// uploadState is how far an upload got: the parts up to Offset have been
+// uploaded, and SHA256 is the marshalled state of the digest of them.
+type uploadState struct {
+	UploadID string `json:"uploadId"`
+	PartSize int64  `json:"partSize"`
+	Offset   int64  `json:"offset"`
+	SHA256   []byte `json:"sha256"`
+}
+
+func newStateFile(path string) *stateFile {
+	if path == "" {
+		return nil
+	}
+	return &stateFile{path: path}
+}
+
+func stateKey(repo, digest string) string {
+	return repo + "@" + digest
+}
+
+// resumeUpload returns the upload of the layer to carry on with, the digest so
+// far and where to carry on from, or a nil upload and a new digest if there
+// isn't one.
+func (c *copier) resumeUpload(repo, digest string) (*ecr.InitiateLayerUploadOutput, hash.Hash, int64, error) {
+
+	sha := sha256.New()
+
+	u, err := c.state.get(repo, digest)
+	if err != nil || u == nil {
+		return nil, sha, 0, err
+	}
+
+	err = sha.(encoding.BinaryUnmarshaler).UnmarshalBinary(u.SHA256)
+	if err != nil {
+		c.log.Warn("Can't resume upload, starting again", "upload", u.UploadID, "layer", digest, "error", err)
+		return nil, sha256.New(), 0, c.state.remove(repo, digest)
+	}
+
+	c.log.Info("Resuming upload", "upload", u.UploadID, "layer", digest, "from", u.Offset)
+
+	return &ecr.InitiateLayerUploadOutput{UploadId: &u.UploadID, PartSize: &u.PartSize}, sha, u.Offset, nil
+}
+
+func (s *stateFile) get(repo, digest string) (*uploadState, error) {
+
+	if s == nil {
+		return nil, nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err := s.load()
+	if err != nil {
+		return nil, err
+	}
+
+	return s.uploads[stateKey(repo, digest)], nil
+}
+
+// save records that the upload has got to offset, with the digest so far.
+func (s *stateFile) save(repo, digest string, upload *ecr.InitiateLayerUploadOutput, sha hash.Hash, offset int64) error {
+
+	if s == nil {
+		return nil
+	}
+
+	shaState, err := sha.(encoding.BinaryMarshaler).MarshalBinary()
+	if err != nil {
+		return fmt.Errorf("state of %s: %w", digest, err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err = s.load()
+	if err != nil {
+		return err
+	}
+
+	s.uploads[stateKey(repo, digest)] = &uploadState{
+		UploadID: *upload.UploadId,
+		PartSize: *upload.PartSize,
+		Offset:   offset,
+		SHA256:   shaState,
+	}
+
+	return s.write()
+}
+
+// remove forgets the layer's upload, once it's done or can't be resumed.
+func (s *stateFile) remove(repo, digest string) error {
+
+	if s == nil {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err := s.load()
+	if err != nil {
+		return err
+	}
+
+	if _, ok := s.uploads[stateKey(repo, digest)]; !ok {
+		return nil
+	}
+	delete(s.uploads, stateKey(repo, digest))
+
+	return s.write()
+}
+
+// load reads the file the first time it's needed.  It's fine for it not to
+// exist yet.
+func (s *stateFile) load() error {
+
+	if s.loaded {
+		return nil
+	}
+
+	s.uploads = map[string]*uploadState{}
+
+	b, err := os.ReadFile(s.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		s.loaded = true
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("state file: %w", err)
+	}
+
+	err = json.Unmarshal(b, &s.uploads)
+	if err != nil {
+		return fmt.Errorf("state file %s: %w", s.path, err)
+	}
+
+	s.loaded = true
+
+	return nil
+}
+
+// write replaces the file, by way of a temporary one so that it's never half
+// written.
+func (s *stateFile) write() error {
+
+	b, err := json.MarshalIndent(s.uploads, "", "  ")
+	if err != nil {
+		return fmt.Errorf("state file: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*")
+	if err != nil {
+		return fmt.Errorf("state file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(b)
+	if err == nil {
+		err = tmp.Close()
+	} else {
+		tmp.Close()
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), s.path)
+	}
+	if err != nil {
+		return fmt.Errorf("state file: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,66 @@
+package ecrcopy
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var (
+	// ECR's rules for repository names, and docker's for other registries,
+	// which also allow __ and runs of - between the alphanumeric parts
+	repoNameRe     = regexp.MustCompile(`^(?:[a-z0-9]+(?:[._-][a-z0-9]+)*/)*[a-z0-9]+(?:[._-][a-z0-9]+)*$`)
+	registryNameRe = regexp.MustCompile(`^(?:[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*/)*[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*$`)
+
+	tagRe = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.-]{0,127}$`)
+)
+
+// CheckRepo checks that repo is a valid ECR repository name, or reference to a
+// repository in another registry, so that a mistake is explained before it
+// gets to the API.
+func CheckRepo(repo string) error {
+
+	if host, name, ok := splitRegistry(repo); ok {
+		if !registryNameRe.MatchString(name) {
+			return fmt.Errorf("repository %q: %q isn't a valid repository name on %s: it must be lowercase letters and digits, separated by . _ - or /", repo, name, host)
+		}
+		return nil
+	}
+
+	if len(repo) < 2 || len(repo) > 256 {
+		return fmt.Errorf("repository name %q: must be 2 to 256 characters", repo)
+	}
+	if !repoNameRe.MatchString(repo) {
+		hint := ""
+		if strings.ToLower(repo) != repo {
+			hint = " (it has upper case letters)"
+		}
+		return fmt.Errorf("repository name %q: must be lowercase letters and digits, separated by single . _ - or /%s", repo, hint)
+	}
+
+	return nil
+}
+
+// CheckTag checks that tag is a valid image tag.
+func CheckTag(tag string) error {
+
+	if !tagRe.MatchString(tag) {
+		return fmt.Errorf("tag %q: must be 1 to 128 letters, digits, _ . or -, and not start with . or -", tag)
+	}
+
+	return nil
+}
+
+// CheckRef checks that ref is a valid tag or digest for CopyImage.
+func CheckRef(ref string) error {
+
+	_, tag, err := parseRef(ref)
+	if err != nil {
+		return err
+	}
+	if tag != "" {
+		return CheckTag(tag)
+	}
+
+	return nil
+}
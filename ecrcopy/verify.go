@@ -0,0 +1,103 @@
+package ecrcopy
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"strings"
+)
+
+// verifySample is how many layers are downloaded to check their content,
+// unless all of them are.
+const verifySample = 3
+
+// verify checks the image is pullable from the destination: that its manifest
+// (and for an index, the platforms' manifests) can be got, that ECR says all
+// its layers are available, and that the content of a few of them, chosen at
+// random, or with full all of them, has the digest in the manifest.
+func (c *copier) verify(ctx context.Context, dstRepo, digest string, full bool, result *Result) error {
+
+	dst := ecrSource{c.dst}
+
+	img, err := c.getManifest(ctx, dst, dstRepo, digest)
+	if err != nil {
+		return fmt.Errorf("verify %s: %w", digest, err)
+	}
+
+	var layers []imageLayer
+	for _, l := range img.allLayers() {
+		if !l.isForeign() {
+			layers = append(layers, l)
+		}
+	}
+
+	var problems []string
+
+	missing, err := c.unavailable(ctx, dstRepo, layers)
+	if err != nil {
+		return fmt.Errorf("verify %s: %w", digest, err)
+	}
+	for _, l := range missing {
+		problems = append(problems, fmt.Sprintf("layer %s isn't available", l.Digest))
+	}
+
+	check := layers
+	if !full && len(check) > verifySample {
+		check = nil
+		for _, i := range rand.Perm(len(layers))[:verifySample] {
+			check = append(check, layers[i])
+		}
+	}
+
+	for _, l := range check {
+		err = c.checkContent(ctx, dst, dstRepo, l)
+		if err != nil {
+			if ctx.Err() != nil {
+				return err
+			}
+			problems = append(problems, err.Error())
+			continue
+		}
+		result.LayersVerified++
+	}
+
+	if len(problems) > 0 {
+		for _, p := range problems {
+			c.log.Error("Verify failed", "repo", dstRepo, "digest", digest, "problem", p)
+		}
+		return fmt.Errorf("verify %s: %s", digest, strings.Join(problems, "; "))
+	}
+
+	c.log.Info("Verified", "repo", dstRepo, "digest", digest, "layers", len(layers), "downloaded", len(check))
+	result.Verified = true
+
+	return nil
+}
+
+// checkContent downloads the layer, and checks its size and digest are what
+// the manifest says.
+func (c *copier) checkContent(ctx context.Context, src source, repo string, l imageLayer) error {
+
+	body := c.newLayerReader(ctx, src, repo, l.Digest, 0)
+	defer body.Close()
+
+	sha := sha256.New()
+	n, err := io.Copy(sha, io.LimitReader(c.limiter.reader(ctx, body), l.Size+1))
+	if err != nil {
+		return fmt.Errorf("layer %s: %w", l.Digest, err)
+	}
+
+	if n != l.Size {
+		return fmt.Errorf("layer %s is %d bytes, not %d", l.Digest, n, l.Size)
+	}
+	if got := "sha256:" + hex.EncodeToString(sha.Sum(nil)); got != l.Digest {
+		return fmt.Errorf("layer %s has digest %s", l.Digest, got)
+	}
+
+	c.log.Debug("Verified layer", "layer", l.Digest, "size", l.Size)
+
+	return nil
+}
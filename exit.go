@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"os"
+
+	"github.com/aws/smithy-go"
+)
+
+// Exit statuses, so that a script can tell what sort of failure it was.
+const (
+	exitFailed   = 1 // anything not below
+	exitNotFound = 2 // the repo or image isn't there
+	exitAuth     = 3 // no credentials, or not allowed
+	exitInvalid  = 4 // bad arguments, or something ECR said was invalid
+	exitNetwork  = 5 // a connection failed or timed out
+)
+
+const exitUsage = `Exit status: 0 if copied, 1 if failed, 2 if a repo or image wasn't found,
+3 for missing credentials or no permission, 4 for invalid arguments, or 5 for a
+network failure or timeout.
+`
+
+// fatal logs the error and exits with the status for its sort of failure.
+func fatal(err error) {
+
+	log.Print(err)
+	os.Exit(exitCode(err))
+}
+
+// exitCode returns the exit status for the error, from the ECR (or STS) error
+// code if it has one, or else the HTTP status or network error.
+func exitCode(err error) int {
+
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		switch apiErr.ErrorCode() {
+		case "RepositoryNotFoundException", "ImageNotFoundException", "LayersNotFoundException",
+			"RegistryNotFoundException", "ScanNotFoundException":
+			return exitNotFound
+		case "AccessDeniedException", "AccessDenied", "UnrecognizedClientException", "InvalidClientTokenId",
+			"ExpiredToken", "ExpiredTokenException", "InvalidSignatureException", "SignatureDoesNotMatch",
+			"MissingAuthenticationToken", "IncompleteSignature":
+			return exitAuth
+		case "InvalidParameterException", "ValidationException", "InvalidTagParameterException",
+			"UnsupportedImageTypeException":
+			return exitInvalid
+		}
+	}
+
+	// The registry API, or the layer downloads
+	var statusErr interface{ HTTPStatusCode() int }
+	if errors.As(err, &statusErr) {
+		switch statusErr.HTTPStatusCode() {
+		case 404:
+			return exitNotFound
+		case 401, 403:
+			return exitAuth
+		}
+	}
+
+	var netErr net.Error
+	var connErr interface{ ConnectionError() bool }
+	switch {
+	case errors.As(err, &netErr), errors.As(err, &connErr) && connErr.ConnectionError(),
+		errors.Is(err, context.DeadlineExceeded):
+		return exitNetwork
+	}
+
+	return exitFailed
+}
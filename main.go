@@ -1,279 +1,777 @@
 package main // "go install hellopiers.io/ecr-copy@latest"
 
 import (
-	"crypto/sha256"
+	"bufio"
+	"context"
 	"encoding/json"
-	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"log"
-	"net/http"
+	"log/slog"
 	"os"
+	"os/signal"
 	"regexp"
+	"strconv"
 	"strings"
-
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/ecr"
+	"syscall"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/aws/aws-sdk-go-v2/service/ecr"
+	"github.com/aws/aws-sdk-go-v2/service/ecr/types"
+	"github.com/aws/aws-sdk-go-v2/service/ecrpublic"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"hellopiers.io/ecr-copy/ecrcopy"
 )
 
 func main() {
 
-	if len(os.Args) < 4 || len(os.Args) > 5 {
-		fmt.Printf("\n  Usage: %s from-repo image-digest-or-tag to-repo [new-tag]\n\n", os.Args[0])
-		os.Exit(1)
+	profile := flag.String("profile", "", "AWS shared config profile to use (default: from the environment)")
+	assumeRoleArn := flag.String("assume-role-arn", "", "IAM role to assume, for the source and the destination unless it has its own")
+	externalID := flag.String("external-id", "", "external ID for assuming -assume-role-arn or -dest-role-arn")
+	sessionName := flag.String("session-name", "", "session name for assuming -assume-role-arn or -dest-role-arn (default: generated)")
+	sourceRegion := flag.String("source-region", "", "region of the source repo (default: from the environment)")
+	destRegion := flag.String("dest-region", "", "region of the destination repo (default: same as the source)")
+	destProfile := flag.String("dest-profile", "", "AWS shared config profile to use for the destination")
+	destRoleArn := flag.String("dest-role-arn", "", "IAM role to assume for the destination")
+	destPublic := flag.Bool("dest-public", false, "to-repo is in this account's ECR Public registry (implied by to-repo public.ecr.aws/alias/name)")
+	concurrency := flag.Int("concurrency", 4, "maximum number of layers to copy at once")
+	maxRetries := flag.Int("max-retries", 5, "maximum retries of a throttled or failed upload call or layer download")
+	maxURLRefreshes := flag.Int("max-url-refreshes", 3, "maximum times a layer download can get a new URL because the one it had expired")
+	createRepo := flag.Bool("create-repo", false, "create the destination repo if it doesn't exist")
+	tagMutability := flag.String("image-tag-mutability", "", "MUTABLE or IMMUTABLE, for a repo made by -create-repo (default: ECR's default)")
+	kmsKey := flag.String("kms-key", "", "ARN or ID of the KMS key the destination repo should be encrypted with, warning if it isn't; a repo made by -create-repo uses it")
+	requireKMS := flag.Bool("require-kms", false, "fail before copying unless the destination repo is encrypted with -kms-key, or with KMS at all")
+	scanOnPush := flag.Bool("scan-on-push", false, "turn on scan on push for a repo made by -create-repo")
+	var tags listFlag
+	flag.Var(&tags, "tag", "tag for the destination image; can be repeated or comma separated, as well as or instead of new-tag")
+	var platforms listFlag
+	flag.Var(&platforms, "platform", "only copy this platform of a multi-platform image, as os/arch[/variant]; can be repeated or comma separated")
+	var rateLimit byteSize
+	flag.Var(&rateLimit, "rate-limit", "most bytes a second to copy, across all layers, e.g. 50MiB or 20MB (default: no limit)")
+	dryRun := flag.Bool("dry-run", false, "report what would be copied, without changing anything")
+	digestOut := flag.String("digest-out", "", "write the digest of the copy in the destination to this file, or - for stdout instead of the summary")
+	output := flag.String("output", "text", "text, or json for a JSON summary on stdout")
+	copySignatures := flag.Bool("copy-signatures", false, "also copy the image's cosign signatures, attestations and SBOMs")
+	overwrite := flag.Bool("overwrite", false, "replace existing destination tags; an error up front if the repo's tags are immutable")
+	deleteSource := flag.Bool("delete-source", false, "delete the image from from-repo once it's copied, i.e. move it")
+	yes := flag.Bool("yes", false, "don't ask for confirmation of -delete-source")
+	quiet := flag.Bool("quiet", false, "don't show upload progress")
+	allTags := flag.Bool("all-tags", false, "copy every tagged image in from-repo, keeping their tags")
+	verify := flag.Bool("verify", false, "once copied, check the image's manifests and layers are in to-repo, and download a few layers to check their digests")
+	verifyFull := flag.Bool("verify-full", false, "like -verify, but download every layer")
+	scan := flag.Bool("scan", false, "start a scan of the copied image, unless the destination repo scans on push")
+	waitScan := flag.Bool("wait-scan", false, "wait for the scan to finish, and show the numbers of findings (implies -scan)")
+	fromFile := flag.String("from-file", "", "copy each image listed in this file, one per line as from-repo image-digest-or-tag to-repo [new-tag]")
+	continueOnError := flag.Bool("continue-on-error", false, "with -from-file, carry on with the rest of the images after one fails")
+	forceRecopy := flag.Bool("force-recopy", false, "upload every layer even if the destination says it has it, to repair a broken image (though ECR keeps a layer it has, with a warning)")
+	retagOnly := flag.Bool("retag-only", false, "only put the manifest with the new tags, failing if any layers aren't in to-repo already (always so when from-repo is to-repo)")
+	preferReplication := flag.Bool("prefer-native-replication", false, "if an ECR replication rule copies the image to the destination, wait for that instead of copying it")
+	replicationWait := flag.Duration("wait", 10*time.Minute, "with -prefer-native-replication, how long to wait for the image to be replicated before copying it anyway")
+	sameDigestCheck := flag.Bool("same-digest-check", false, "don't copy the image if the destination tags are already it")
+	stateFile := flag.String("state-file", "", "file to keep the progress of layer uploads in, so an interrupted copy can resume them")
+	logLevel := flag.String("log-level", "info", "error, warn, info, or debug for the details of each call")
+	timeout := flag.Duration("timeout", 0, "give up if the whole copy takes longer than this, e.g. 30m (default: no limit)")
+	httpTimeout := flag.Duration("http-timeout", time.Minute, "how long to wait for a layer download's response, or for more of it, before reconnecting")
+
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "\n  Usage: %s [flags] from-repo image-digest-or-tag to-repo [new-tag]\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "     or: %s [flags] -all-tags from-repo to-repo\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "     or: %s [flags] -from-file images.txt\n\n", os.Args[0])
+		flag.PrintDefaults()
+		fmt.Fprintln(flag.CommandLine.Output())
+		fmt.Fprint(flag.CommandLine.Output(), exitUsage)
 	}
-
-	sourceRepo := os.Args[1]
-	imageDigestOrTag := os.Args[2] // if it's xxx:hex then assume a digest, otherwise a tag
-	destRepo := os.Args[3]
-	newTag := ""
-	if len(os.Args) == 5 {
-		newTag = os.Args[4]
+	flag.CommandLine.Init(os.Args[0], flag.ContinueOnError)
+	if err := flag.CommandLine.Parse(os.Args[1:]); err != nil {
+		if err == flag.ErrHelp {
+			os.Exit(0)
+		}
+		os.Exit(exitInvalid)
 	}
 
-	// Credentials to do what we need to do must be available to the SDK in one of
-	// the standard ways.
-	sess := session.Must(session.NewSession())
-	ecrClient := ecr.New(sess)
+	var sourceRepo, imageDigestOrTag, destRepo string
+	var refs []string // from stdin, if there's more than one
+	switch {
+	case *fromFile != "" && flag.NArg() == 0 && !*allTags:
+	case *allTags && flag.NArg() == 2:
+		sourceRepo = flag.Arg(0)
+		destRepo = flag.Arg(1)
+	case !*allTags && *fromFile == "" && flag.NArg() >= 3 && flag.NArg() <= 4:
+		sourceRepo = flag.Arg(0)
+		imageDigestOrTag = flag.Arg(1) // a tag, or sha256:hex or name@sha256:hex for a digest
+		destRepo = flag.Arg(2)
+		if flag.NArg() == 4 {
+			tags = append(tags, flag.Arg(3))
+		}
+		if imageDigestOrTag == "-" {
+			if *deleteSource && !*yes && !*dryRun {
+				fmt.Fprintln(flag.CommandLine.Output(), "-delete-source needs -yes when the image-digest-or-tag is read from stdin")
+				os.Exit(exitInvalid)
+			}
+			var err error
+			refs, err = readRefs(os.Stdin)
+			if err != nil {
+				fmt.Fprintln(flag.CommandLine.Output(), err)
+				os.Exit(exitInvalid)
+			}
+			if len(refs) > 1 && len(tags) > 0 {
+				fmt.Fprintf(flag.CommandLine.Output(), "Can't give %d images from stdin the same new tag\n", len(refs))
+				os.Exit(exitInvalid)
+			}
+			imageDigestOrTag = refs[0]
+			if len(refs) == 1 {
+				refs = nil
+			}
+		}
+		if len(tags) == 0 && len(refs) == 0 && isTag(imageDigestOrTag) {
+			tags = []string{imageDigestOrTag}
+		}
+	default:
+		flag.Usage()
+		os.Exit(exitInvalid)
+	}
 
-	manifest, layers, err := getManifest(sourceRepo, imageDigestOrTag, ecrClient)
+	// A repo given with its ECR registry's host, as docker has it, is in that
+	// region and account
+	srcECR, srcIsECR, err := splitECRRepo(sourceRepo)
 	if err != nil {
-		log.Fatal(err)
+		fmt.Fprintln(flag.CommandLine.Output(), err)
+		os.Exit(exitInvalid)
 	}
-
-	neededLayers, err := checkLayerAvails(destRepo, layers, ecrClient)
+	if srcIsECR {
+		sourceRepo = useECRRepo(srcECR, sourceRegion, "source-region")
+	}
+	dstECR, dstIsECR, err := splitECRRepo(destRepo)
 	if err != nil {
-		log.Fatal(err)
+		fmt.Fprintln(flag.CommandLine.Output(), err)
+		os.Exit(exitInvalid)
+	}
+	if dstIsECR {
+		destRepo = useECRRepo(dstECR, destRegion, "dest-region")
 	}
 
-	log.Printf("Manifest has %d layers, need to copy %d of them", len(layers), len(neededLayers))
+	if err := checkArgs(sourceRepo, imageDigestOrTag, destRepo, tags); err != nil {
+		fmt.Fprintln(flag.CommandLine.Output(), err)
+		os.Exit(exitInvalid)
+	}
+	for _, ref := range refs {
+		if err := ecrcopy.CheckRef(ref); err != nil {
+			fmt.Fprintf(flag.CommandLine.Output(), "stdin: %v\n", err)
+			os.Exit(exitInvalid)
+		}
+	}
 
-	err = copyLayers(sourceRepo, destRepo, neededLayers, ecrClient)
-	if err != nil {
-		log.Fatal(err)
+	for _, p := range platforms {
+		if parts := strings.Split(p, "/"); len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+			fmt.Fprintf(flag.CommandLine.Output(), "Invalid -platform %q, want os/arch or os/arch/variant, e.g. linux/amd64\n", p)
+			os.Exit(exitInvalid)
+		}
 	}
 
-	err = putManifest(destRepo, newTag, manifest, ecrClient)
-	if err != nil {
-		log.Fatal(err)
+	if *output != "text" && *output != "json" {
+		fmt.Fprintf(flag.CommandLine.Output(), "Invalid -output %q\n", *output)
+		os.Exit(exitInvalid)
 	}
 
-	log.Printf("Copied %s from %s to %s", imageDigestOrTag, sourceRepo, destRepo)
-}
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(*logLevel)); err != nil {
+		fmt.Fprintf(flag.CommandLine.Output(), "Invalid -log-level %q\n", *logLevel)
+		os.Exit(exitInvalid)
+	}
 
-func getManifest(sourceRepo, imageDigestOrTag string, ecrClient *ecr.ECR) (*string, []imageLayer, error) {
+	*tagMutability = strings.ToUpper(*tagMutability)
+	switch types.ImageTagMutability(*tagMutability) {
+	case "", types.ImageTagMutabilityMutable, types.ImageTagMutabilityImmutable:
+	default:
+		fmt.Fprintf(flag.CommandLine.Output(), "Invalid -image-tag-mutability %q\n", *tagMutability)
+		os.Exit(exitInvalid)
+	}
 
-	input := &ecr.BatchGetImageInput{
-		RepositoryName: &sourceRepo,
-		ImageIds:       []*ecr.ImageIdentifier{{}},
+	if _, _, isPublic := splitPublicRepo(destRepo); (*kmsKey != "" || *requireKMS) && (isPublic || *destPublic) {
+		fmt.Fprintln(flag.CommandLine.Output(), "-kms-key and -require-kms can't be used for ECR Public, which doesn't encrypt with KMS")
+		os.Exit(exitInvalid)
 	}
-	if _, hex, didCut := strings.Cut(imageDigestOrTag, ":"); didCut && hexRe.MatchString(hex) {
-		input.ImageIds[0].ImageDigest = &imageDigestOrTag
-	} else {
-		input.ImageIds[0].ImageTag = &imageDigestOrTag
+
+	if _, _, isPublic := splitPublicRepo(destRepo); (*verify || *verifyFull) && (isPublic || *destPublic || *allTags) {
+		fmt.Fprintln(flag.CommandLine.Output(), "-verify and -verify-full can't be used with -all-tags, or for ECR Public, which can't be downloaded from with the ECR API")
+		os.Exit(exitInvalid)
 	}
 
-	img, err := ecrClient.BatchGetImage(input)
-	if err != nil {
-		return nil, nil, fmt.Errorf("BatchGetImage: %w", err)
+	if *allTags && len(tags) > 0 {
+		fmt.Fprintln(flag.CommandLine.Output(), "-tag can't be used with -all-tags, which copies every tag as itself")
+		os.Exit(exitInvalid)
+	}
+	if *deleteSource && *allTags {
+		fmt.Fprintln(flag.CommandLine.Output(), "-delete-source can't be used with -all-tags")
+		os.Exit(exitInvalid)
+	}
+	if *deleteSource && len(platforms) > 0 {
+		fmt.Fprintln(flag.CommandLine.Output(), "-delete-source can't be used with -platform, since it would delete all the platforms from the source")
+		os.Exit(exitInvalid)
+	}
+	if *fromFile != "" && len(tags) > 0 {
+		fmt.Fprintln(flag.CommandLine.Output(), "-tag can't be used with -from-file; give the new tag on the image's line")
+		os.Exit(exitInvalid)
+	}
+	var copies []ecrcopy.ImageCopy
+	if *fromFile != "" {
+		var err error
+		copies, err = readCopies(*fromFile)
+		if err != nil {
+			fmt.Fprintln(flag.CommandLine.Output(), err)
+			os.Exit(exitInvalid)
+		}
 	}
 
-	if len(img.Images) != 1 {
-		return nil, nil, fmt.Errorf("BatchGetImage: Got %d Images", len(img.Images))
+	if *digestOut != "" && (*allTags || *fromFile != "" || len(refs) > 0) {
+		fmt.Fprintln(flag.CommandLine.Output(), "-digest-out is only for copying a single image")
+		os.Exit(exitInvalid)
+	}
+	if *digestOut == "-" && *output == "json" {
+		fmt.Fprintln(flag.CommandLine.Output(), "-digest-out - can't be used with -output json, which has the digest as destDigest")
+		os.Exit(exitInvalid)
 	}
 
-	var m manifest
-	manifestBytes := []byte(*(img.Images[0].ImageManifest))
-	err = json.Unmarshal(manifestBytes, &m)
-	if err != nil {
-		return nil, nil, fmt.Errorf("Unmarshal ImageManifest: %w", err)
+	// The copy checks this too, but it's better found out before being asked
+	// to confirm.  The destination can only be told apart from the flags if
+	// it's somewhere else.
+	_, _, destIsPublic := splitPublicRepo(destRepo)
+	elsewhere := destIsPublic || *destPublic || *destProfile != "" || *destRoleArn != "" ||
+		(*destRegion != "" && *destRegion != *sourceRegion) || srcIsECR != dstIsECR || srcECR.account != dstECR.account
+	if *deleteSource && !elsewhere {
+		pairs := copies
+		if *fromFile == "" {
+			pairs = []ecrcopy.ImageCopy{{SourceRepo: sourceRepo, DestRepo: destRepo}}
+		}
+		for _, ic := range pairs {
+			if ic.SourceRepo == ic.DestRepo {
+				fmt.Fprintf(flag.CommandLine.Output(), "-delete-source would delete the copy, since %s is both from-repo and to-repo\n", ic.SourceRepo)
+				os.Exit(exitInvalid)
+			}
+		}
 	}
 
-	allLayers := append(m.Layers, m.Config)
+	if *deleteSource && *fromFile != "" && !*yes && !*dryRun && !confirm(fmt.Sprintf("Delete each of the %d images from its source repo once it's copied?", len(copies))) {
+		fmt.Fprintln(os.Stderr, "Not copied")
+		os.Exit(exitFailed)
+	}
+	if *deleteSource && *fromFile == "" && !*yes && !*dryRun && !confirm(fmt.Sprintf("Delete image %s from %s once it's copied?", imageDigestOrTag, sourceRepo)) {
+		fmt.Fprintln(os.Stderr, "Not copied")
+		os.Exit(exitFailed)
+	}
 
-	return img.Images[0].ImageManifest, allLayers, nil
-}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-func checkLayerAvails(destRepo string, layers []imageLayer, ecrClient *ecr.ECR) ([]imageLayer, error) {
+	if *timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *timeout)
+		defer cancel()
+	}
 
-	batchInput := &ecr.BatchCheckLayerAvailabilityInput{
-		RepositoryName: &destRepo,
+	// Credentials to do what we need to do must be available to the SDK in one of
+	// the standard ways, or from -profile, possibly to assume -assume-role-arn.
+	srcCfg := loadConfig(ctx, *sourceRegion, *profile)
+	if *assumeRoleArn != "" {
+		assumeRole(&srcCfg, *assumeRoleArn, *externalID, *sessionName)
 	}
-	for _, l := range layers {
-		l := l // de-alias
-		batchInput.LayerDigests = append(batchInput.LayerDigests, &l.Digest)
+	var srcClient ecrcopy.Client = ecr.NewFromConfig(srcCfg)
+	if srcIsECR {
+		srcClient = ecrcopy.NewRegistryClient(ecr.NewFromConfig(srcCfg), srcECR.account)
 	}
 
-	avails, err := ecrClient.BatchCheckLayerAvailability(batchInput)
-	if err != nil {
-		return nil, fmt.Errorf("BatchCheckLayerAvailability: %w", err)
+	// The destination defaults to the same credentials and region as the source.
+	// A -dest-role-arn is assumed from whichever of them it ends up with, so a CI
+	// runner's base role can assume a role to write to another account.
+	dstCfg := srcCfg.Copy()
+	switch {
+	case *destProfile != "":
+		region := *destRegion
+		if region == "" {
+			region = srcCfg.Region
+		}
+		dstCfg = loadConfig(ctx, region, *destProfile)
+	case *destRegion != "":
+		dstCfg.Region = *destRegion
+	}
+	if *destRoleArn != "" {
+		assumeRole(&dstCfg, *destRoleArn, *externalID, *sessionName)
+	}
+	var dstClient ecrcopy.Client = ecr.NewFromConfig(dstCfg)
+	if dstIsECR {
+		dstClient = ecrcopy.NewRegistryClient(ecr.NewFromConfig(dstCfg), dstECR.account)
 	}
 
-	destHasLayer := map[string]bool{}
-	for _, la := range avails.Layers {
-		if *la.LayerAvailability == `AVAILABLE` {
-			destHasLayer[*la.LayerDigest] = true
+	// An ECR Public repo is named without the alias in its API, and the API is
+	// only in us-east-1
+	alias, publicRepo, isPublic := splitPublicRepo(destRepo)
+	if isPublic || *destPublic {
+		if isPublic {
+			destRepo = publicRepo
 		}
+		pubClient := ecrpublic.NewFromConfig(dstCfg, func(o *ecrpublic.Options) {
+			o.Region = "us-east-1"
+		})
+		if isPublic {
+			checkPublicAlias(ctx, pubClient, alias)
+		}
+		dstClient = ecrcopy.NewPublicClient(pubClient)
 	}
 
-	var unavailLayers []imageLayer
-	for _, l := range layers {
-		if destHasLayer[l.Digest] {
-			continue
+	opts := ecrcopy.Options{
+		Dest:              dstClient,
+		Concurrency:       *concurrency,
+		MaxRetries:        *maxRetries,
+		MaxURLRefreshes:   *maxURLRefreshes,
+		DryRun:            *dryRun,
+		CopySignatures:    *copySignatures,
+		DeleteSource:      *deleteSource,
+		Overwrite:         *overwrite,
+		ContinueOnError:   *continueOnError,
+		Scan:              *scan,
+		Verify:            *verify,
+		VerifyFull:        *verifyFull,
+		WaitScan:          *waitScan,
+		HTTPTimeout:       *httpTimeout,
+		StateFile:         *stateFile,
+		Platforms:         platforms,
+		ForceRecopy:       *forceRecopy,
+		RetagOnly:         *retagOnly,
+		SkipUpToDate:      *sameDigestCheck,
+		PreferReplication: *preferReplication,
+		ReplicationWait:   *replicationWait,
+		RateLimit:         int64(rateLimit),
+		KMSKey:            *kmsKey,
+		RequireKMS:        *requireKMS,
+	}
+	if *createRepo {
+		opts.CreateRepo = &ecrcopy.RepoSettings{
+			ImageTagMutability: types.ImageTagMutability(*tagMutability),
+			ScanOnPush:         *scanOnPush,
 		}
-		unavailLayers = append(unavailLayers, l)
 	}
 
-	return unavailLayers, nil
-}
+	// Log lines go above the progress line, if there is one
+	var logOutput io.Writer = os.Stderr
+	if !*quiet {
+		progress := newProgressReporter(os.Stderr)
+		log.SetOutput(progress)
+		logOutput = progress
+		opts.Progress = progress
+	}
+	opts.Logger = slog.New(slog.NewTextHandler(logOutput, &slog.HandlerOptions{Level: level}))
+
+	// Several refs from stdin are copied like -from-file, to the same repo
+	for _, ref := range refs {
+		ic := ecrcopy.ImageCopy{SourceRepo: sourceRepo, Ref: ref, DestRepo: destRepo}
+		if isTag(ref) {
+			ic.Tags = []string{ref}
+		}
+		copies = append(copies, ic)
+	}
 
-func copyLayers(sourceRepo, destRepo string, layers []imageLayer, ecrClient *ecr.ECR) error {
+	if len(copies) > 0 {
+		start := time.Now()
+		results := ecrcopy.CopyImages(ctx, copies, srcClient, opts)
+		if err := printBatch(copies, results, time.Since(start), *output == "json"); err != nil {
+			os.Exit(exitCode(err))
+		}
+		return
+	}
 
-	for _, l := range layers {
-		err := copyLayer(sourceRepo, destRepo, l.Digest, ecrClient)
+	var result *ecrcopy.Result
+	if *allTags {
+		result, err = ecrcopy.CopyRepository(ctx, sourceRepo, destRepo, srcClient, opts)
+	} else {
+		result, err = ecrcopy.CopyImage(ctx, sourceRepo, imageDigestOrTag, destRepo, tags, srcClient, opts)
+	}
+	if err != nil {
+		fatal(err)
+	}
+
+	if *digestOut != "" && !*dryRun {
+		err = writeDigest(*digestOut, result.DestDigest)
 		if err != nil {
-			return fmt.Errorf("copyLayer: %w", err)
+			fatal(err)
+		}
+		if *digestOut == "-" {
+			return
 		}
 	}
 
-	return nil
+	switch {
+	case *output == "json":
+		printJSON(result)
+	case *dryRun:
+		printDryRun(sourceRepo, imageDigestOrTag, destRepo, tags, result)
+	case result.UpToDate:
+		fmt.Printf("Already up to date: %s is %s\n", destRepo, result.DestDigest)
+	case result.Replicated:
+		fmt.Printf("Replicated by ECR: %s is %s\n", destRepo, result.DestDigest)
+	default:
+		printSummary(result.BytesTransferred, result.LayersCopied, result.BytesSkipped, result.Duration)
+		if result.ScanStatus != "" {
+			printScan(result)
+		}
+	}
+	if result.Verified && *output != "json" && !*dryRun {
+		fmt.Printf("Verified: %s is pullable, with %d layers downloaded again and checked\n", result.DestDigest, result.LayersVerified)
+	}
 }
 
-func copyLayer(sourceRepo, destRepo string, layerDigest string, ecrClient *ecr.ECR) error {
+// writeDigest writes the digest on its own to the file, or stdout for -, for
+// the next step of a pipeline to use.
+func writeDigest(path, digest string) error {
 
-	dlUrl, err := ecrClient.GetDownloadUrlForLayer(&ecr.GetDownloadUrlForLayerInput{
-		RepositoryName: &sourceRepo,
-		LayerDigest:    &layerDigest,
-	})
-	if err != nil {
-		return fmt.Errorf("GetDownloadUrlForLayer(%s): %w", layerDigest, err)
+	if path == "-" {
+		_, err := fmt.Println(digest)
+		return err
 	}
 
-	upload, err := ecrClient.InitiateLayerUpload(&ecr.InitiateLayerUploadInput{
-		RepositoryName: &destRepo,
-	})
-	if err != nil {
-		return fmt.Errorf("InitiateLayerUpload: %w", err)
+	return os.WriteFile(path, []byte(digest+"\n"), 0o644)
+}
+
+// confirm asks the question on stderr, and returns whether the answer on stdin
+// was yes.
+func confirm(question string) bool {
+
+	fmt.Fprintf(os.Stderr, "%s [y/N] ", question)
+
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+
+	return answer == "y" || answer == "yes"
+}
+
+// splitPublicRepo splits public.ecr.aws/<alias>/<name> into the registry alias
+// and the repository name.
+func splitPublicRepo(repo string) (alias, name string, ok bool) {
+
+	rest, ok := strings.CutPrefix(repo, ecrcopy.PublicRegistryHost+"/")
+	if !ok {
+		return "", "", false
 	}
 
-	resp, err := http.Get(*dlUrl.DownloadUrl)
-	if err != nil {
-		return fmt.Errorf("http GET layer(%s): %w", layerDigest, err)
+	alias, name, ok = strings.Cut(rest, "/")
+
+	return alias, name, ok && alias != "" && name != ""
+}
+
+// ecrHost matches a private ECR registry's host, as docker logs in and pushes
+// to it, giving its account ID and region.
+var ecrHost = regexp.MustCompile(`^([0-9]{12})\.dkr\.ecr(?:-fips)?\.([a-z0-9-]+)\.amazonaws\.com(?:\.cn)?$`)
+
+// ecrRepo is a repo given with its registry's host, e.g.
+// 111111111111.dkr.ecr.eu-west-1.amazonaws.com/team/app.
+type ecrRepo struct {
+	account, region, name string
+}
+
+// splitECRRepo splits a repo given with a private ECR registry's host into the
+// registry's account and region and the repo's name there.  ok is false for a
+// repo that's just a name, or is in some other registry, and err is for a host
+// that looks like ECR's but isn't one.
+func splitECRRepo(repo string) (r ecrRepo, ok bool, err error) {
+
+	host, name, found := strings.Cut(repo, "/")
+	if !found {
+		return ecrRepo{}, false, nil
 	}
-	defer resp.Body.Close()
 
-	b := make([]byte, *upload.PartSize)
-	var partFirstByte int64 = 0
-	sha := sha256.New()
+	m := ecrHost.FindStringSubmatch(host)
+	if m == nil {
+		if strings.HasSuffix(host, ".amazonaws.com") || strings.HasSuffix(host, ".amazonaws.com.cn") {
+			return ecrRepo{}, false, fmt.Errorf("%s isn't an ECR registry, which is like 111111111111.dkr.ecr.us-east-1.amazonaws.com", host)
+		}
+		return ecrRepo{}, false, nil
+	}
 
-	log.Printf("Starting upload %s", *upload.UploadId)
+	return ecrRepo{account: m[1], region: m[2], name: name}, true, nil
+}
 
-	lastPart := false
-	for !lastPart {
-		partSize := 0
+// hasRegistryHost is whether the repo starts with a registry's host, which
+// like docker is a first part with a dot or a colon in it, or localhost.
+func hasRegistryHost(repo string) bool {
 
-	downloadPart:
-		// the GET reader can return less than we want; this inner loop aggregates till we have a full part or it's the end of the layer
-		for {
-			n, err := resp.Body.Read(b[partSize:])
+	host, _, found := strings.Cut(repo, "/")
 
-			// A non EOF error - bail:
-			if err != nil && !errors.Is(err, io.EOF) {
-				return fmt.Errorf("Read(%s): %w", layerDigest, err)
-			}
+	return found && (strings.ContainsAny(host, ".:") || host == "localhost")
+}
 
-			// A zero size read
-			if n == 0 {
-				// With EOF - process what we have
-				if errors.Is(err, io.EOF) {
-					lastPart = true
-					break downloadPart
-				}
-				// Without EOF - try again
-				continue downloadPart
-			}
+// useECRRepo takes the region for a repo given with its ECR registry's host
+// from the host, and returns its name there, or exits if it conflicts with the
+// region flag.
+func useECRRepo(r ecrRepo, region *string, regionFlag string) string {
 
-			partSize += n
+	if *region != "" && *region != r.region {
+		fmt.Fprintf(flag.CommandLine.Output(), "-%s %s doesn't match the registry's region %s\n", regionFlag, *region, r.region)
+		os.Exit(exitInvalid)
+	}
+	*region = r.region
 
-			// Full buffer - process it
-			if partSize == int(*upload.PartSize) {
-				break downloadPart
-			}
-		}
+	return r.name
+}
 
-		if partSize == 0 {
-			if lastPart {
-				// edge case where layer was exactly divisible by the part size?
-				break
+// checkPublicAlias makes sure the alias is this account's public registry,
+// since that's where the copy will go whatever alias it's given.
+func checkPublicAlias(ctx context.Context, client *ecrpublic.Client, alias string) {
+
+	o, err := client.DescribeRegistries(ctx, &ecrpublic.DescribeRegistriesInput{})
+	if err != nil {
+		fatal(fmt.Errorf("DescribeRegistries: %w", err))
+	}
+
+	var aliases []string
+	for _, r := range o.Registries {
+		for _, a := range r.Aliases {
+			if aws.ToString(a.Name) == alias {
+				return
 			}
-			panic("internal logic error")
+			aliases = append(aliases, aws.ToString(a.Name))
 		}
+	}
 
-		partLastByte := partFirstByte + int64(partSize) - 1
+	log.Printf("%s/%s isn't this account's public registry, which has aliases %s", ecrcopy.PublicRegistryHost, alias, strings.Join(aliases, ", "))
+	os.Exit(exitInvalid)
+}
 
-		log.Printf("Uploading %d bytes from %d to %d", partSize, partFirstByte, partLastByte)
+// checkArgs checks the repos, ref and tags to copy, any of which may be empty
+// if they're not needed, so that mistakes are explained before any AWS calls.
+func checkArgs(sourceRepo, ref, destRepo string, tags []string) error {
 
-		_, err = ecrClient.UploadLayerPart(&ecr.UploadLayerPartInput{
-			LayerPartBlob:  b[:partSize],
-			PartFirstByte:  &partFirstByte,
-			PartLastByte:   &partLastByte,
-			RepositoryName: &destRepo,
-			UploadId:       upload.UploadId,
-		})
-		if err != nil {
-			return fmt.Errorf("UploadLayerPart(%s) (%d-%d): %w", layerDigest, partFirstByte, partLastByte, err)
+	for _, repo := range []string{sourceRepo, destRepo} {
+		if repo == "" {
+			continue
 		}
+		if err := ecrcopy.CheckRepo(repo); err != nil {
+			return err
+		}
+	}
 
-		sha.Write(b[:partSize])
+	// Other registries can be copied from, but only ECR written to
+	if _, _, isPublic := splitPublicRepo(destRepo); hasRegistryHost(destRepo) && !isPublic {
+		return fmt.Errorf("Can't copy to %s, which isn't in ECR or ECR Public", destRepo)
+	}
 
-		partFirstByte += int64(partSize)
+	if ref != "" {
+		if err := ecrcopy.CheckRef(ref); err != nil {
+			return err
+		}
 	}
 
-	uploadDigest := fmt.Sprintf("%s:%064x", *upload.UploadId, sha.Sum(nil))
-	layer, err := ecrClient.CompleteLayerUpload(&ecr.CompleteLayerUploadInput{
-		RepositoryName: &destRepo,
-		UploadId:       upload.UploadId,
-		LayerDigests:   []*string{&uploadDigest},
-	})
-	if err != nil {
-		return fmt.Errorf("CompleteLayerUpload(%s): %w", layerDigest, err)
+	for _, tag := range tags {
+		if err := ecrcopy.CheckTag(tag); err != nil {
+			return err
+		}
 	}
 
-	log.Printf("%#v", layer)
+	return nil
+}
+
+// isTag is whether the image ref is a tag, rather than a digest, which always
+// has a colon in it.
+func isTag(ref string) bool {
+	return !strings.ContainsAny(ref, ":@")
+}
 
+// listFlag is a flag that can be given several times, each with one or more
+// comma separated values, e.g. tags.
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *listFlag) Set(s string) error {
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			*l = append(*l, v)
+		}
+	}
 	return nil
 }
 
-func putManifest(destRepo, newTag string, manifest *string, ecrClient *ecr.ECR) error {
+// byteSize is a flag for a number of bytes, with an optional unit such as MB
+// (a million) or MiB (2^20), and optionally /s for a rate.
+type byteSize int64
+
+var byteUnits = map[string]float64{
+	"": 1, "b": 1,
+	"kb": 1e3, "mb": 1e6, "gb": 1e9,
+	"k": 1 << 10, "m": 1 << 20, "g": 1 << 30,
+	"kib": 1 << 10, "mib": 1 << 20, "gib": 1 << 30,
+}
+
+func (b *byteSize) String() string {
+	return strconv.FormatInt(int64(*b), 10)
+}
+
+func (b *byteSize) Set(s string) error {
 
-	input := &ecr.PutImageInput{
-		RepositoryName: &destRepo,
-		ImageManifest:  manifest,
+	s = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(s)), "/s")
+	number := strings.TrimRight(s, "abcdefghijklmnopqrstuvwxyz ")
+	unit, ok := byteUnits[strings.TrimSpace(s[len(number):])]
+	if !ok {
+		return fmt.Errorf("unknown unit in %q, want e.g. 50MiB or 20MB", s)
 	}
 
-	if newTag != "" {
-		input.ImageTag = &newTag
+	n, err := strconv.ParseFloat(number, 64)
+	if err != nil || n < 0 {
+		return fmt.Errorf("want a number of bytes, e.g. 50MiB or 20MB, got %q", s)
 	}
 
-	o, err := ecrClient.PutImage(input)
+	*b = byteSize(n * unit)
+
+	return nil
+}
+
+// printJSON writes the result to stdout, for scripts.  Everything else goes to
+// stderr, so this is all there is on stdout.
+func printJSON(result *ecrcopy.Result) {
+
+	out := struct {
+		*ecrcopy.Result
+		DurationSeconds float64 `json:"durationSeconds"`
+	}{result, result.Duration.Seconds()}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	err := enc.Encode(out)
 	if err != nil {
-		return fmt.Errorf("PutImage: %w", err)
+		fatal(err)
 	}
+}
 
-	log.Printf("%#v", o)
+// printDryRun says what a copy would have done.
+func printDryRun(sourceRepo, imageDigestOrTag, destRepo string, tags []string, result *ecrcopy.Result) {
 
-	return nil
+	dest := destRepo + " untagged"
+	switch {
+	case len(tags) > 0:
+		dest = destRepo + ":" + strings.Join(tags, ",")
+	case imageDigestOrTag == "":
+		imageDigestOrTag = "all tags"
+		dest = destRepo + " with the same tags"
+	}
+
+	fmt.Printf("Dry run: %s %s -> %s\n", sourceRepo, imageDigestOrTag, dest)
+	fmt.Printf("  Images:    %d\n", result.Images)
+	fmt.Printf("  Layers:    %d\n", result.Layers)
+	fmt.Printf("  To copy:   %d (%s)\n", result.LayersNeeded, formatBytes(result.BytesNeeded))
+	switch {
+	case result.UpToDate:
+		fmt.Println("  Already up to date")
+	case result.Replicated:
+		fmt.Println("  Would wait for ECR replication instead")
+	}
 }
 
-type manifest struct {
-	Config imageLayer
-	Layers []imageLayer
+// printScan says how the scan went, with the numbers of findings if it was
+// waited for.
+func printScan(result *ecrcopy.Result) {
+
+	if result.ScanFindings == nil {
+		fmt.Printf("Scan: %s\n", result.ScanStatus)
+		return
+	}
+
+	// Most severe first, then anything else ECR comes up with
+	severities := []types.FindingSeverity{
+		types.FindingSeverityCritical,
+		types.FindingSeverityHigh,
+		types.FindingSeverityMedium,
+		types.FindingSeverityLow,
+		types.FindingSeverityInformational,
+		types.FindingSeverityUndefined,
+	}
+	var counts []string
+	seen := map[string]bool{}
+	for _, sev := range severities {
+		seen[string(sev)] = true
+		if n := result.ScanFindings[string(sev)]; n > 0 {
+			counts = append(counts, fmt.Sprintf("%s %d", sev, n))
+		}
+	}
+	for sev, n := range result.ScanFindings {
+		if !seen[sev] && n > 0 {
+			counts = append(counts, fmt.Sprintf("%s %d", sev, n))
+		}
+	}
+	if len(counts) == 0 {
+		counts = []string{"none"}
+	}
+
+	fmt.Printf("Scan: %s, findings: %s\n", result.ScanStatus, strings.Join(counts, ", "))
 }
 
-type imageLayer struct {
-	MediaType string
-	Size      int64
-	Digest    string
+// printSummary says how much was copied, and how quickly, e.g.
+//
+//	Transferred 1.8 GiB across 12 layers in 47s (39.2 MiB/s), skipped 3.1 GiB already there
+func printSummary(transferred int64, layers int, skipped int64, duration time.Duration) {
+
+	var rate int64
+	if duration > 0 {
+		rate = int64(float64(transferred) / duration.Seconds())
+	}
+
+	fmt.Printf("Transferred %s across %d layers in %v (%s/s), skipped %s already there\n",
+		formatBytes(transferred), layers, duration.Round(time.Second/10), formatBytes(rate), formatBytes(skipped))
 }
 
-var hexRe = regexp.MustCompile(`^[a-f0-9]+$`)
+// formatBytes formats n in binary units, e.g. "1.8 GiB".
+func formatBytes(n int64) string {
+
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// loadConfig returns the AWS config for the region and profile, either of which
+// may be empty to use whatever the environment says.
+func loadConfig(ctx context.Context, region, profile string) aws.Config {
+
+	var opts []func(*config.LoadOptions) error
+	if region != "" {
+		opts = append(opts, config.WithRegion(region))
+	}
+	if profile != "" {
+		opts = append(opts, config.WithSharedConfigProfile(profile))
+	}
+
+	// which fails for a profile that isn't there, or a bad config file
+	cfg, err := config.LoadDefaultConfig(ctx, opts...)
+	if err != nil {
+		log.Print(err)
+		os.Exit(exitAuth)
+	}
+
+	return cfg
+}
+
+// assumeRole changes cfg's credentials to those of the role, assumed with its
+// current ones.
+func assumeRole(cfg *aws.Config, roleArn, externalID, sessionName string) {
+
+	provider := stscreds.NewAssumeRoleProvider(sts.NewFromConfig(*cfg), roleArn, func(o *stscreds.AssumeRoleOptions) {
+		if externalID != "" {
+			o.ExternalID = &externalID
+		}
+		if sessionName != "" {
+			o.RoleSessionName = sessionName
+		}
+	})
+	cfg.Credentials = aws.NewCredentialsCache(provider)
+}
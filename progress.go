@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// progressInterval is how often progress is logged when it can't be shown in
+// place, e.g. in CI logs.
+const progressInterval = 10 * time.Second
+
+// progressReporter shows how the layer uploads are going on stderr.  On a
+// terminal it's a line updated in place; otherwise it's a line every
+// progressInterval.  It implements ecrcopy.Progress.
+//
+// It's also the log output, so log lines don't get mixed up with the progress
+// line.
+type progressReporter struct {
+	mu    sync.Mutex
+	out   io.Writer
+	isTTY bool
+
+	started    time.Time
+	lastLogged time.Time
+	layers     int
+	size       int64
+	done       map[string]bool // the layers which have finished
+	layerSizes map[string]int64
+	uploaded   map[string]int64
+	shown      bool // whether there's a progress line to clear
+}
+
+func newProgressReporter(out *os.File) *progressReporter {
+
+	isTTY := false
+	if fi, err := out.Stat(); err == nil {
+		isTTY = fi.Mode()&os.ModeCharDevice != 0
+	}
+
+	return &progressReporter{out: out, isTTY: isTTY}
+}
+
+func (p *progressReporter) Start(layers int, size int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.started = time.Now()
+	p.lastLogged = p.started
+	p.layers = layers
+	p.size = size
+	p.done = map[string]bool{}
+	p.layerSizes = map[string]int64{}
+	p.uploaded = map[string]int64{}
+}
+
+func (p *progressReporter) LayerProgress(digest string, uploaded, size int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.layerSizes[digest] = size
+	p.uploaded[digest] = uploaded
+	finished := uploaded >= size && !p.done[digest]
+	if finished {
+		p.done[digest] = true
+	}
+
+	switch {
+	case p.isTTY:
+		p.clear()
+		io.WriteString(p.out, p.line())
+		p.shown = true
+	case finished || time.Since(p.lastLogged) >= progressInterval:
+		fmt.Fprintln(p.out, p.line())
+		p.lastLogged = time.Now()
+	}
+}
+
+func (p *progressReporter) Finish() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.shown {
+		io.WriteString(p.out, "\n")
+		p.shown = false
+	}
+}
+
+// Write is for the log output: it puts what's logged above the progress line.
+func (p *progressReporter) Write(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.clear()
+	n, err := p.out.Write(b)
+	if p.shown {
+		io.WriteString(p.out, p.line())
+	}
+
+	return n, err
+}
+
+// clear blanks the progress line, if there is one.
+func (p *progressReporter) clear() {
+	if p.shown {
+		io.WriteString(p.out, "\r\033[K")
+	}
+}
+
+// line describes the overall progress, and each layer in progress.
+func (p *progressReporter) line() string {
+
+	var total int64
+	var inProgress []string
+	for digest, uploaded := range p.uploaded {
+		total += uploaded
+		if size := p.layerSizes[digest]; uploaded < size {
+			inProgress = append(inProgress, fmt.Sprintf("%s %d%%", shortDigest(digest), percent(uploaded, size)))
+		}
+	}
+	sort.Strings(inProgress)
+
+	var rate float64
+	if elapsed := time.Since(p.started).Seconds(); elapsed > 0 {
+		rate = float64(total) / elapsed
+	}
+
+	s := fmt.Sprintf("%d/%d layers, %s of %s (%d%%), %s/s",
+		len(p.done), p.layers, formatBytes(total), formatBytes(p.size), percent(total, p.size), formatBytes(int64(rate)))
+	if len(inProgress) > 0 {
+		s += " | " + strings.Join(inProgress, " ")
+	}
+
+	return s
+}
+
+func percent(n, of int64) int64 {
+	if of <= 0 {
+		return 100
+	}
+	return n * 100 / of
+}
+
+// shortDigest is the start of the digest's hex, like docker shows.
+func shortDigest(digest string) string {
+	_, hex, _ := strings.Cut(digest, ":")
+	if len(hex) > 12 {
+		hex = hex[:12]
+	}
+	return hex
+}